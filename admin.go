@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serveAdmin exposes the admin API over HTTP on l. It does not return.
+func (d *daemon) serveAdmin(l net.Listener) {
+	addr := l.Addr().String()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hosts", d.adminHosts)
+	mux.HandleFunc("/hosts/", d.adminHost)
+	mux.HandleFunc("/sessions", d.adminSessions)
+	mux.HandleFunc("/sessions/", d.adminSession)
+	mux.HandleFunc("/drain", d.adminDrain)
+	logger.Log("admin", fields{"address": addr}, "serving admin API on %s", addr)
+	err := http.Serve(l, d.adminAuth(mux))
+	logger.Log("admin", fields{"address": addr, "error": err.Error()}, "admin server failed: %v", err)
+}
+
+// adminAuth only lets requests carrying the admin token as a bearer token
+// through to h.
+func (d *daemon) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := d.state().conf.AdminToken
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminHosts lists the hosts on GET, and adds one on POST.
+func (d *daemon) adminHosts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, redactProxies(d.state().conf.Hosts))
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var h Host
+		if err := json.Unmarshal(body, &h); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.Address == "" {
+			http.Error(w, "address is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := d.addHost(h, body); err != nil {
+			status := http.StatusBadRequest
+			if err == errHostExists {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		logger.Log("admin", fields{"target": h.Address, "remote_addr": r.RemoteAddr}, "%s: host %s added", r.RemoteAddr, h.Address)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, redactProxies([]Host{h})[0])
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminHost removes a host on DELETE.
+func (d *daemon) adminHost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	address := strings.TrimPrefix(r.URL.Path, "/hosts/")
+	if err := d.removeHost(address); err != nil {
+		status := http.StatusBadRequest
+		switch err {
+		case errNoSuchHost:
+			status = http.StatusNotFound
+		case errHostNotPersisted:
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	logger.Log("admin", fields{"target": address, "remote_addr": r.RemoteAddr}, "%s: host %s removed", r.RemoteAddr, address)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSessions lists the open sessions on GET.
+func (d *daemon) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, d.sessions.describeAll())
+}
+
+// adminSession closes a session on DELETE.
+func (d *daemon) adminSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	s := d.sessions.byID(id)
+	if s == nil {
+		http.Error(w, errNoSuchSession.Error(), http.StatusNotFound)
+		return
+	}
+
+	f := s.describe()
+	f["killed_by"] = r.RemoteAddr
+	logger.Log("session_killed", f, "%s: closing session %d of %s on request of %s", s.conn.RemoteAddr(), id, f["username"], r.RemoteAddr)
+	s.conn.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Log("admin", fields{"error": err.Error()}, "could not encode response: %v", err)
+	}
+}
+
+var (
+	errHostExists = errors.New("host already exists")
+	errNoSuchHost = errors.New("no such host")
+
+	// errHostNotPersisted is returned for hosts defined in another file
+	// than the one hosts are persisted to, where they cannot be removed.
+	errHostNotPersisted = errors.New("host is not defined in the last configuration file")
+
+	errNoSuchSession = errors.New("no such session")
+)
+
+// addHost adds a host to the hosts of the configuration file. raw is the
+// host as given, which is what is written back to the file if adminPersist
+// is set.
+func (d *daemon) addHost(h Host, raw []byte) error {
+	if err := h.resolve(d.state().conf.Groups); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The host may not clash with the fetched hosts either, by address,
+	// name or alias.
+	st := d.state()
+	for _, t := range h.targets() {
+		if st.conf.host(st.canonical(t)) != nil {
+			return errHostExists
+		}
+	}
+	hosts := append(append([]Host(nil), d.base.conf.Hosts...), h)
+	if err := d.setHosts(hosts); err != nil {
+		return err
+	}
+
+	if d.base.conf.AdminPersist {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		return persistHosts(d.filenames[len(d.filenames)-1], func(hosts []interface{}) []interface{} {
+			return append(hosts, v)
+		})
+	}
+	return nil
+}
+
+// removeHost removes a host from the hosts of the configuration. If adminPersist
+// is set, it is also removed from the last configuration file, and hosts
+// defined elsewhere, such as in an include, cannot be removed.
+func (d *daemon) removeHost(address string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	persist := d.base.conf.AdminPersist
+	var filename string
+	if persist {
+		filename = d.filenames[len(d.filenames)-1]
+	}
+	if persist && d.base.conf.host(address) != nil {
+		ok, err := definesHost(filename, address)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errHostNotPersisted
+		}
+	}
+
+	var hosts []Host
+	for _, h := range d.base.conf.Hosts {
+		if h.Address != address {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == len(d.base.conf.Hosts) {
+		return errNoSuchHost
+	}
+	if err := d.setHosts(hosts); err != nil {
+		return err
+	}
+
+	if persist {
+		return persistHosts(filename, func(hosts []interface{}) []interface{} {
+			var res []interface{}
+			for _, h := range hosts {
+				if m, ok := h.(map[string]interface{}); ok && m["address"] == address {
+					continue
+				}
+				res = append(res, h)
+			}
+			return res
+		})
+	}
+	return nil
+}
+
+// setHosts replaces the hosts of the configuration file. d.mu must be held.
+func (d *daemon) setHosts(hosts []Host) error {
+	c := *d.base.conf
+	c.Hosts = hosts
+
+	st, err := newState(&c, d.base.users)
+	if err != nil {
+		return err
+	}
+	st.cas = d.base.cas
+	st.denied = d.base.denied
+
+	old := d.base
+	d.base = st
+	if err := d.rebuild(); err != nil {
+		d.base = old
+		return err
+	}
+	return nil
+}
+
+// persistHosts rewrites the "hosts" array of a configuration file with
+// update. The rest of the file is kept, but comments and formatting are
+// definesHost reports whether the hosts of the configuration file list a
+// host with the given address.
+func definesHost(filename, address string) (bool, error) {
+	var conf struct {
+		Hosts []struct {
+			Address string `json:"address" yaml:"address"`
+		} `json:"hosts" yaml:"hosts"`
+	}
+	if err := decodeFile(filename, &conf); err != nil {
+		return false, err
+	}
+	for _, h := range conf.Hosts {
+		if h.Address == address {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// not.
+func persistHosts(filename string, update func([]interface{}) []interface{}) error {
+	var conf map[string]interface{}
+	if err := decodeFile(filename, &conf); err != nil {
+		return err
+	}
+
+	hosts, _ := conf["hosts"].([]interface{})
+	conf["hosts"] = update(hosts)
+
+	var (
+		b   []byte
+		err error
+	)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		b, err = yaml.Marshal(conf)
+	default:
+		b, err = json.MarshalIndent(conf, "", "\t")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	st, err := newState(&Conf{AdminToken: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+	h := d.adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/hosts", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, w.Code, tt.status)
+		}
+	}
+}
+
+func TestRemoveHostPersisted(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	authkeys := write("authkeys", "")
+	write("included.json", `{"hosts": [{"address": "included.example.com:22", "users": ["*"]}]}`)
+	conf := write("conf.json", `{
+		"authkeys": "`+authkeys+`",
+		"adminPersist": true,
+		"include": ["`+filepath.Join(dir, "included.json")+`"],
+		"hosts": [{"address": "ssh1.example.com:22", "users": ["*"]}]
+	}`)
+
+	files := []string{conf}
+	st, err := loadState(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(files, st)
+
+	if err := d.removeHost("included.example.com:22"); err != errHostNotPersisted {
+		t.Fatalf("removing an included host returned %v, want %v", err, errHostNotPersisted)
+	}
+	if d.state().conf.host("included.example.com:22") == nil {
+		t.Fatal("included host removed")
+	}
+
+	if err := d.removeHost("ssh1.example.com:22"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := definesHost(conf, "ssh1.example.com:22"); err != nil || ok {
+		t.Fatalf("host still in the configuration file (%v)", err)
+	}
+	if err := d.reload(files); err != nil {
+		t.Fatal(err)
+	}
+	if d.state().conf.host("ssh1.example.com:22") != nil {
+		t.Fatal("removed host back after reload")
+	}
+}
+
+func TestAddHostClashingWithFetched(t *testing.T) {
+	st, err := newState(&Conf{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+	if err := d.setFetched([]Host{{Address: "fetched.example.com:22", Name: "fetched", Users: []string{"*"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range []string{
+		`{"address": "fetched.example.com:22", "users": ["*"]}`,
+		`{"address": "other.example.com:22", "name": "fetched", "users": ["*"]}`,
+	} {
+		var h Host
+		if err := json.Unmarshal([]byte(raw), &h); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.addHost(h, []byte(raw)); err != errHostExists {
+			t.Errorf("adding %s returned %v, want %v", raw, err, errHostExists)
+		}
+	}
+
+	raw := `{"address": "new.example.com:22", "users": ["*"]}`
+	var h Host
+	json.Unmarshal([]byte(raw), &h)
+	if err := d.addHost(h, []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if d.state().conf.host("new.example.com:22") == nil || d.state().conf.host("fetched.example.com:22") == nil {
+		t.Fatal("hosts missing after adding one")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvents are the log events that are also written to the audit log.
+var auditEvents = map[string]bool{
+	"auth_denied":      true,
+	"auth_revoked":     true,
+	"auth_throttled":   true,
+	"cert_rejected":    true,
+	"geoip_blocked":    true,
+	"authorized":       true,
+	"selection_denied": true,
+	"confirmed":        true,
+	"confirm_denied":   true,
+	"connecting":       true,
+	"disconnect":       true,
+	"session_killed":   true,
+	"session_expired":  true,
+}
+
+// auditLog writes security relevant events as JSON lines to a file of their
+// own, regardless of the format and level of the main log.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+var audit = &auditLog{}
+
+// open (re)opens the audit log at path for appending, closing the file
+// opened before. An empty path disables the audit log.
+func (a *auditLog) open(path string) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	old := a.f
+	a.path, a.f = path, f
+	a.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// record writes an event to the audit log, if it is open.
+func (a *auditLog) record(event string, f fields) {
+	rec := make(map[string]interface{}, len(f)+2)
+	for k, v := range f {
+		rec[k] = v
+	}
+	rec["time"] = logger.timestamp(time.Now())
+	rec["event"] = event
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		a.f.Write(b)
+	}
+}
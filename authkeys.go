@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/joushou/sshmux"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authEntry is an entry of the authkeys file.
+type authEntry struct {
+	user *sshmux.User
+
+	// options holds all options of the entry, including the ones that are
+	// not understood.
+	options []string
+
+	// from and notFrom hold the networks of a from= option. If from is
+	// not empty, the key may only be used from those networks, and never
+	// from those in notFrom.
+	from    []*net.IPNet
+	notFrom []*net.IPNet
+
+	// permitOpen holds the patterns of permitopen= options. If not empty,
+	// the key may only be used to reach hosts matching one of them.
+	permitOpen []string
+
+	// metadata holds the key=value tokens of the comment, such as
+	// "team=ops".
+	metadata map[string]string
+
+	// command is the value of a command= option. sshmux cannot force a
+	// command, so keys with one are refused rather than given more access
+	// than intended.
+	command string
+}
+
+// permitsRemote reports whether the key may be used to reach a remote host.
+func (e *authEntry) permitsRemote(remote string) bool {
+	if len(e.permitOpen) == 0 {
+		return true
+	}
+	for _, pattern := range e.permitOpen {
+		if ok, _ := path.Match(pattern, remote); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// permitsSource reports whether the key may be used from addr.
+func (e *authEntry) permitsSource(addr net.Addr) bool {
+	if len(e.from) == 0 && len(e.notFrom) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range e.notFrom {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(e.from) == 0 {
+		return true
+	}
+	for _, n := range e.from {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFrom parses the value of a from= option, a comma-separated list of
+// addresses and CIDR networks, each optionally negated with "!".
+func (e *authEntry) parseFrom(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var n *net.IPNet
+		if strings.Contains(p, "/") {
+			_, cidr, err := net.ParseCIDR(p)
+			if err != nil {
+				return fmt.Errorf("from=: invalid network %q", p)
+			}
+			n = cidr
+		} else {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return fmt.Errorf("from=: only addresses and networks are supported, not %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		if negated {
+			e.notFrom = append(e.notFrom, n)
+		} else {
+			e.from = append(e.from, n)
+		}
+	}
+	return nil
+}
+
+// parseOptions applies the authorized_keys options of the entry.
+// Unsupported options are kept, but otherwise ignored.
+func (e *authEntry) parseOptions(options []string) error {
+	e.options = options
+	for _, o := range options {
+		name, value := o, ""
+		if i := strings.IndexByte(o, '='); i >= 0 {
+			v, err := strconv.Unquote(o[i+1:])
+			if err != nil {
+				return fmt.Errorf("malformed option %q", o)
+			}
+			name, value = o[:i], v
+		}
+
+		switch strings.ToLower(name) {
+		case "from":
+			if err := e.parseFrom(value); err != nil {
+				return err
+			}
+		case "permitopen":
+			if _, err := path.Match(value, ""); err != nil {
+				return fmt.Errorf("permitopen=: invalid pattern %q", value)
+			}
+			e.permitOpen = append(e.permitOpen, value)
+		case "command":
+			e.command = value
+		default:
+			logger.Log("authkeys_option", fields{"username": e.user.Name, "option": name},
+				"%s: ignoring unsupported option %s", e.user.Name, name)
+		}
+	}
+	return nil
+}
+
+// parseAuthFile reads and parses a file in authorized_keys format. The file
+// may also be an http or https URL, which is fetched with the given bearer
+// token.
+func parseAuthFile(filename, token string, strict bool) ([]*authEntry, error) {
+	if isURL(filename) {
+		return fetchAuthFile(filename, token, strict)
+	}
+
+	authFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthData(filename, authFile, strict)
+}
+
+// parseAuthData parses authorized_keys data read from filename.
+func parseAuthData(filename string, authFile []byte, strict bool) ([]*authEntry, error) {
+	var entries []*authEntry
+
+	// Parse authfile as authorized_key, one line at a time, so that a bad
+	// line can be skipped.
+	skipped := 0
+	seen := make(map[string]*authEntry)
+	for i, line := range bytes.Split(authFile, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		e, err := parseAuthLine(line)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("line %d: %v (%s)", i+1, err, snippet(line))
+			}
+			logger.Log("authkeys", fields{"file": filename, "line": i + 1, "error": err.Error()},
+				"%s:%d: skipping entry: %v (%s)", filename, i+1, err, snippet(line))
+			skipped++
+			continue
+		}
+
+		// A key listed more than once is a mistake, as only the first entry
+		// is ever used.
+		id := keyID(e.user.PublicKey)
+		if first, ok := seen[id]; ok {
+			if strict {
+				return nil, fmt.Errorf("line %d: key of %s is already listed for %s", i+1, e.user.Name, first.user.Name)
+			}
+			logger.Log("authkeys", fields{"file": filename, "line": i + 1, "username": e.user.Name, "first": first.user.Name},
+				"%s:%d: key of %s is already listed for %s, which takes precedence", filename, i+1, e.user.Name, first.user.Name)
+		} else {
+			seen[id] = e
+		}
+
+		entries = append(entries, e)
+	}
+
+	if skipped > 0 {
+		logger.Log("authkeys", fields{"file": filename, "loaded": len(entries), "skipped": skipped},
+			"%s: loaded %d keys, skipped %d", filename, len(entries), skipped)
+	}
+
+	return entries, nil
+}
+
+// snippet returns the start of a line for use in error messages.
+func snippet(line []byte) string {
+	const max = 40
+	if len(line) > max {
+		return strconv.Quote(string(line[:max]) + "...")
+	}
+	return strconv.Quote(string(line))
+}
+
+// parseAuthLine parses a single line of an authorized_keys file.
+func parseAuthLine(line []byte) (*authEntry, error) {
+	pk, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, err
+	}
+
+	name, metadata := parseComment(comment)
+	e := &authEntry{
+		user: &sshmux.User{
+			PublicKey: pk,
+			Name:      name,
+		},
+		metadata: metadata,
+	}
+
+	if err := e.parseOptions(options); err != nil {
+		return nil, fmt.Errorf("%s: %v", comment, err)
+	}
+
+	return e, nil
+}
+
+// parseComment splits the comment of an authkeys entry into the name of the
+// user and the metadata given as key=value tokens, so that
+// "alice team=ops email=alice@example.com" is the user "alice". A comment
+// without any key=value tokens is the name as a whole.
+func parseComment(comment string) (string, map[string]string) {
+	var names []string
+	var metadata map[string]string
+	for _, t := range strings.Fields(comment) {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 {
+			names = append(names, t)
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[t[:i]] = t[i+1:]
+	}
+	if metadata == nil {
+		return comment, nil
+	}
+	return strings.Join(names, " "), metadata
+}
+
+// keyID returns a string uniquely identifying a public key, for use as a map
+// key.
+func keyID(key ssh.PublicKey) string {
+	return key.Type() + string(key.Marshal())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var authKeysClient = &http.Client{Timeout: 10 * time.Second}
+
+// cachedAuthFile is the last successfully parsed content of an authkeys URL.
+type cachedAuthFile struct {
+	etag    string
+	entries []*authEntry
+}
+
+// authKeysCache holds the last known good entries of every authkeys URL, so
+// that unchanged content is not parsed again, and a failed fetch does not
+// lock everyone out.
+var authKeysCache = struct {
+	sync.Mutex
+	files map[string]*cachedAuthFile
+}{files: make(map[string]*cachedAuthFile)}
+
+// isURL reports whether an authkeys setting is a URL rather than a file.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// fetchAuthFile fetches and parses authorized_keys data from url. If
+// fetching or parsing fails, the entries fetched last are returned, if
+// there are any.
+func fetchAuthFile(url, token string, strict bool) ([]*authEntry, error) {
+	authKeysCache.Lock()
+	defer authKeysCache.Unlock()
+	cached := authKeysCache.files[url]
+
+	var etag string
+	if cached != nil {
+		etag = cached.etag
+	}
+
+	b, tag, err := fetchAuthData(url, token, etag)
+	if err == nil && b == nil {
+		// Not modified.
+		return cached.entries, nil
+	}
+
+	var entries []*authEntry
+	if err == nil {
+		entries, err = parseAuthData(url, b, strict)
+	}
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		logger.Log("authkeys", fields{"url": url, "error": err.Error()},
+			"loading %s failed, keeping last known keys: %v", url, err)
+		return cached.entries, nil
+	}
+
+	authKeysCache.files[url] = &cachedAuthFile{etag: tag, entries: entries}
+	return entries, nil
+}
+
+// fetchAuthData fetches the content of url. If the server reports that the
+// content has not changed since etag, the returned tag equals etag and no
+// content is returned.
+func fetchAuthData(url, token, etag string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := authKeysClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return nil, etag, nil
+	case resp.StatusCode == http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, resp.Header.Get("ETag"), nil
+}
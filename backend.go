@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"gopkg.in/yaml.v3"
+)
+
+// backendAddr is an entry of the addresses of a host. It is written either
+// as just the address, or as an object with the address and a weight.
+type backendAddr struct {
+	Address string `json:"address" yaml:"address"`
+	Weight  *int   `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// weight returns the share of new sessions the backend gets, relative to
+// the other backends of the host. It defaults to 1. Backends with a weight
+// of 0 are drained, and not connected to.
+func (b backendAddr) weight() int {
+	if b.Weight == nil {
+		return 1
+	}
+	return *b.Weight
+}
+
+func (b *backendAddr) set(v backendAddr) error {
+	if v.Address == "" {
+		return errors.New("backend address is required")
+	}
+	if v.Weight != nil && *v.Weight < 0 {
+		return errors.New("backend weight must not be negative")
+	}
+	*b = v
+	return nil
+}
+
+func (b *backendAddr) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return b.set(backendAddr{Address: s})
+	}
+
+	var v struct {
+		Address string `json:"address"`
+		Weight  *int   `json:"weight"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return b.set(backendAddr{Address: v.Address, Weight: v.Weight})
+}
+
+func (b *backendAddr) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return b.set(backendAddr{Address: n.Value})
+	}
+
+	var v struct {
+		Address string `yaml:"address"`
+		Weight  *int   `yaml:"weight"`
+	}
+	if err := n.Decode(&v); err != nil {
+		return err
+	}
+	return b.set(backendAddr{Address: v.Address, Weight: v.Weight})
+}
+
+func (b backendAddr) MarshalJSON() ([]byte, error) {
+	if b.Weight == nil {
+		return json.Marshal(b.Address)
+	}
+	return json.Marshal(struct {
+		Address string `json:"address"`
+		Weight  int    `json:"weight"`
+	}{b.Address, *b.Weight})
+}
+
+// backends returns the addresses of the backends of the host that are not
+// drained.
+func (h *Host) backends() []string {
+	var res []string
+	for _, b := range h.Addresses {
+		if b.weight() > 0 {
+			res = append(res, b.Address)
+		}
+	}
+	return res
+}
+
+// backendOrder returns the backends to try for the k-th session to the host,
+// starting with the one picked by weight, followed by the other backends
+// that are not drained.
+func (h *Host) backendOrder(k uint32) []string {
+	total := 0
+	for _, b := range h.Addresses {
+		total += b.weight()
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := len(h.Addresses)
+	pos, start := int(k%uint32(total)), 0
+	for i, b := range h.Addresses {
+		if pos < b.weight() {
+			start = i
+			break
+		}
+		pos -= b.weight()
+	}
+
+	res := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if b := h.Addresses[(start+i)%n]; b.weight() > 0 {
+			res = append(res, b.Address)
+		}
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// banList bans IP addresses that fail to authenticate too often.
+type banList struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	banned   map[string]time.Time
+}
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string][]time.Time),
+		banned:   make(map[string]time.Time),
+	}
+}
+
+// fail records a failed authentication from ip. Once max failures happened
+// within window, the address is banned for the given duration, and fail
+// returns true.
+func (b *banList) fail(ip string, max int, window, duration time.Duration) bool {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recent := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < max {
+		b.failures[ip] = recent
+		return false
+	}
+
+	delete(b.failures, ip)
+	b.banned[ip] = now.Add(duration)
+	return true
+}
+
+// isBanned reports whether ip is currently banned.
+func (b *banList) isBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.banned[ip]
+	return ok && time.Now().Before(until)
+}
+
+// cleanup lifts expired bans, returning the unbanned addresses, and forgets
+// failures older than window.
+func (b *banList) cleanup(window time.Duration) []string {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var unbanned []string
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, ip)
+			unbanned = append(unbanned, ip)
+		}
+	}
+
+	for ip, failures := range b.failures {
+		if len(failures) == 0 || now.Sub(failures[len(failures)-1]) >= window {
+			delete(b.failures, ip)
+		}
+	}
+
+	sort.Strings(unbanned)
+	return unbanned
+}
+
+// list returns the banned addresses and when their bans expire.
+func (b *banList) list() map[string]time.Time {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make(map[string]time.Time, len(b.banned))
+	for ip, until := range b.banned {
+		if now.Before(until) {
+			res[ip] = until
+		}
+	}
+	return res
+}
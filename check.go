@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// checkConfig loads the configuration and everything it refers to, and
+// reports the problems found. It returns false if there were any.
+func checkConfig(filenames []string) bool {
+	filename := strings.Join(filenames, ", ")
+	st, err := loadState(filenames)
+	if err != nil {
+		fmt.Printf("%s: %v\n", filename, err)
+		return false
+	}
+
+	var problems []string
+	if _, err := loadHostKey(st.conf); err != nil {
+		problems = append(problems, fmt.Sprintf("hostkey: %v", err))
+	}
+
+	for _, h := range st.conf.Hosts {
+		addrs := []string{h.Address}
+		for _, b := range h.Addresses {
+			addrs = append(addrs, b.Address)
+		}
+		if h.FallbackAddress != "" {
+			addrs = append(addrs, h.FallbackAddress)
+		}
+		for _, a := range addrs {
+			if _, _, err := net.SplitHostPort(a); err != nil {
+				problems = append(problems, fmt.Sprintf("host %s: invalid address %q: %v", h.Address, a, err))
+			}
+		}
+		if !h.NoAuth && len(h.Users) == 0 && len(h.RequireTags) == 0 {
+			problems = append(problems, fmt.Sprintf("host %s: no users are permitted", h.Address))
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", filename, p)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+
+	fmt.Printf("%s: OK, %d hosts, %d users\n", filename, len(st.conf.Hosts), len(st.users))
+	return true
+}
+
+// printConfig writes the configuration as loaded, after includes and
+// environment variable expansion, as JSON to stdout. The admin token is
+// left out.
+func printConfig(filenames []string) error {
+	c, err := parseConf(filenames...)
+	if err != nil {
+		return err
+	}
+
+	if c.AdminToken != "" {
+		c.AdminToken = "(hidden)"
+	}
+	if c.AuthKeysToken != "" {
+		c.AuthKeysToken = "(hidden)"
+	}
+	if c.HostKeyData != "" {
+		c.HostKeyData = "(hidden)"
+	}
+	c.Hosts = redactProxies(c.Hosts)
+
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", b)
+	return err
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/joushou/sshmux"
+	"gopkg.in/yaml.v3"
+)
+
+type Host struct {
+	Name        string        `json:"name" yaml:"name"`
+	Aliases     []string      `json:"aliases" yaml:"aliases"`
+	Address     string        `json:"address" yaml:"address"`
+	Addresses   []backendAddr `json:"addresses" yaml:"addresses"`
+	Users       []string      `json:"users" yaml:"users"`
+	RequireTags []string      `json:"requireTags" yaml:"requireTags"`
+	NoAuth      bool          `json:"noAuth" yaml:"noAuth"`
+	NoAuthFrom  []string      `json:"noAuthFrom" yaml:"noAuthFrom"`
+	Hidden      bool          `json:"hidden" yaml:"hidden"`
+
+	FallbackAddress  string   `json:"fallbackAddress" yaml:"fallbackAddress"`
+	DialTimeout      duration `json:"dialTimeout" yaml:"dialTimeout"`
+	Proxy            string   `json:"proxy" yaml:"proxy"`
+	Jump             []string `json:"jump" yaml:"jump"`
+	JumpIdentityFile string   `json:"jumpIdentityFile" yaml:"jumpIdentityFile"`
+
+	KnownHosts               string `json:"knownHosts" yaml:"knownHosts"`
+	InsecureSkipHostKeyCheck bool   `json:"insecureSkipHostKeyCheck" yaml:"insecureSkipHostKeyCheck"`
+
+	MaxSessionDuration duration `json:"maxSessionDuration" yaml:"maxSessionDuration"`
+	MaxConnections     int      `json:"maxConnections" yaml:"maxConnections"`
+
+	AccessWindows []string `json:"accessWindows" yaml:"accessWindows"`
+	ConfirmPrompt string   `json:"confirmPrompt" yaml:"confirmPrompt"`
+
+	// names and patterns hold the users after group expansion, split into
+	// exact names and glob patterns.
+	names    map[string]bool
+	patterns []string
+
+	windows []*accessWindow
+
+	// noAuthNets holds the parsed noAuthFrom networks.
+	noAuthNets []*net.IPNet
+
+	// tmpl is set for hosts whose address is a template, and match is the
+	// glob pattern that the rendered addresses match.
+	tmpl  *template.Template
+	match string
+}
+
+// targets returns what the host can be asked for by: its address, and its
+// name and aliases. Names and aliases without a port get the port of the
+// address.
+func (h *Host) targets() []string {
+	res := []string{h.Address}
+
+	_, port, err := net.SplitHostPort(h.Address)
+	names := h.Aliases
+	if h.Name != "" {
+		names = append([]string{h.Name}, names...)
+	}
+	for _, n := range names {
+		if _, _, e := net.SplitHostPort(n); e != nil && err == nil {
+			n = net.JoinHostPort(n, port)
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// addressData is what templated addresses are rendered with.
+type addressData struct {
+	User string
+}
+
+// validHostUser matches the user names that may be rendered into a templated
+// address.
+var validHostUser = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// parseTemplate prepares a templated address, such as
+// "{{.User}}.dev.internal:22". Plain addresses are left alone.
+func (h *Host) parseTemplate() error {
+	h.tmpl = nil
+	h.match = ""
+	if !strings.Contains(h.Address, "{{") {
+		return nil
+	}
+
+	if len(h.Addresses) > 0 || len(h.Aliases) > 0 || h.FallbackAddress != "" {
+		return fmt.Errorf("host %s: a templated address cannot have addresses, aliases or a fallbackAddress", h.Address)
+	}
+
+	t, err := template.New(h.Address).Option("missingkey=error").Parse(h.Address)
+	if err != nil {
+		return fmt.Errorf("host %s: %v", h.Address, err)
+	}
+
+	// Render the template with a marker standing in for the user, and turn
+	// the result into a pattern that every rendered address matches.
+	const marker = "\x00"
+	var b strings.Builder
+	if err := t.Execute(&b, addressData{User: marker}); err != nil {
+		return fmt.Errorf("host %s: %v", h.Address, err)
+	}
+	if !strings.Contains(b.String(), marker) {
+		return fmt.Errorf("host %s: templated address does not use the user", h.Address)
+	}
+	var match strings.Builder
+	for i, part := range strings.Split(b.String(), marker) {
+		if i > 0 {
+			match.WriteString("*")
+		}
+		for _, r := range part {
+			if strings.ContainsRune(`*?[\`, r) {
+				match.WriteRune('\\')
+			}
+			match.WriteRune(r)
+		}
+	}
+
+	h.tmpl = t
+	h.match = match.String()
+	return nil
+}
+
+// render returns the address of the host for the given user. Templated
+// addresses need an authenticated user, so they are unavailable to anonymous
+// sessions.
+func (h *Host) render(user *sshmux.User) (string, error) {
+	if h.tmpl == nil {
+		return h.Address, nil
+	}
+	if user == nil {
+		return "", fmt.Errorf("%s requires an authenticated user", h.Address)
+	}
+	if !validHostUser.MatchString(user.Name) {
+		return "", fmt.Errorf("user name %q cannot be used in address %s", user.Name, h.Address)
+	}
+	var b strings.Builder
+	if err := h.tmpl.Execute(&b, addressData{User: user.Name}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// grants reports whether the client of a session may access the host: either
+// without authentication, or because the user is listed in the host's users,
+// or because the metadata of the user's authkeys entry has all of the host's
+// required tags.
+func (h *Host) grants(session *sshmux.Session, entry *authEntry) bool {
+	if h.noAuthFor(session.Conn.RemoteAddr()) {
+		return true
+	}
+	if session.User == nil {
+		return false
+	}
+	return h.permits(session.User.Name) || h.hasTags(entry)
+}
+
+// hasTags reports whether the metadata of an authkeys entry has all of the
+// host's required tags. Hosts without required tags are not granted by tags.
+func (h *Host) hasTags(entry *authEntry) bool {
+	if len(h.RequireTags) == 0 || entry == nil {
+		return false
+	}
+	for _, t := range h.RequireTags {
+		i := strings.IndexByte(t, '=')
+		if v, ok := entry.metadata[t[:i]]; !ok || v != t[i+1:] {
+			return false
+		}
+	}
+	return true
+}
+
+// noAuthFor reports whether the host may be accessed without authentication
+// by a client connecting from addr.
+func (h *Host) noAuthFor(addr net.Addr) bool {
+	if !h.NoAuth {
+		return false
+	}
+	if len(h.noAuthNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.noAuthNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// open reports whether the host may be accessed at time t, according to its
+// access windows. Hosts without access windows are always open.
+func (h *Host) open(t time.Time) bool {
+	if len(h.windows) == 0 {
+		return true
+	}
+	for _, w := range h.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve prepares a host definition for use, expanding user groups, parsing
+// templated addresses, checking the proxy and jump hosts and required tags,
+// and parsing the noAuthFrom networks and access windows.
+func (h *Host) resolve(groups map[string][]string) error {
+	if err := h.resolveUsers(groups); err != nil {
+		return err
+	}
+
+	if err := h.parseTemplate(); err != nil {
+		return err
+	}
+
+	if h.Proxy != "" {
+		if _, err := parseProxy(h.Proxy); err != nil {
+			return fmt.Errorf("host %s: proxy: %v", h.Address, err)
+		}
+	}
+
+	for _, j := range h.Jump {
+		if _, _, err := parseJump(j); err != nil {
+			return fmt.Errorf("host %s: %v", h.Address, err)
+		}
+	}
+	if len(h.Jump) > 0 && h.JumpIdentityFile == "" {
+		return fmt.Errorf("host %s: jump requires jumpIdentityFile", h.Address)
+	}
+
+	for _, t := range h.RequireTags {
+		if strings.IndexByte(t, '=') <= 0 {
+			return fmt.Errorf("host %s: requireTags: %q is not of the form key=value", h.Address, t)
+		}
+	}
+
+	h.noAuthNets = nil
+	for _, s := range h.NoAuthFrom {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("host %s: noAuthFrom: invalid network %q", h.Address, s)
+		}
+		h.noAuthNets = append(h.noAuthNets, n)
+	}
+
+	h.windows = nil
+	for _, s := range h.AccessWindows {
+		w, err := parseAccessWindow(s)
+		if err != nil {
+			return fmt.Errorf("host %s: %v", h.Address, err)
+		}
+		h.windows = append(h.windows, w)
+	}
+	return nil
+}
+
+// permits reports whether the named user is listed in the host's users.
+// Entries are glob patterns as understood by path.Match, so "ops-*" matches
+// every user whose name starts with "ops-", and "*" matches every user.
+func (h *Host) permits(name string) bool {
+	if h.names[name] {
+		return true
+	}
+	for _, pattern := range h.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUsers expands group references in the host's users and checks the
+// resulting patterns for errors.
+func (h *Host) resolveUsers(groups map[string][]string) error {
+	users, err := expandGroups(h.Users, groups, nil)
+	if err != nil {
+		return fmt.Errorf("host %s: %v", h.Address, err)
+	}
+
+	h.names = make(map[string]bool)
+	h.patterns = nil
+	for _, u := range users {
+		if _, err := path.Match(u, ""); err != nil {
+			return fmt.Errorf("host %s: invalid user pattern %q", h.Address, u)
+		}
+		if strings.ContainsAny(u, `*?[\`) {
+			h.patterns = append(h.patterns, u)
+		} else {
+			h.names[u] = true
+		}
+	}
+	return nil
+}
+
+// expandGroups replaces "@group" entries with the members of the group,
+// recursively. visiting holds the groups currently being expanded, and is
+// used to detect cycles.
+func expandGroups(users []string, groups map[string][]string, visiting map[string]bool) ([]string, error) {
+	var res []string
+	for _, u := range users {
+		if !strings.HasPrefix(u, "@") {
+			res = append(res, u)
+			continue
+		}
+
+		name := u[1:]
+		members, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown group %q", name)
+		}
+		if visiting[name] {
+			return nil, fmt.Errorf("group %q includes itself", name)
+		}
+
+		if visiting == nil {
+			visiting = make(map[string]bool)
+		}
+		visiting[name] = true
+		expanded, err := expandGroups(members, groups, visiting)
+		delete(visiting, name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, expanded...)
+	}
+	return res, nil
+}
+
+type Conf struct {
+	Address                  string              `json:"address" yaml:"address"`
+	Addresses                []string            `json:"addresses" yaml:"addresses"`
+	SocketMode               string              `json:"socketMode" yaml:"socketMode"`
+	TCPNoDelay               *bool               `json:"tcpNoDelay" yaml:"tcpNoDelay"`
+	TCPKeepalive             duration            `json:"tcpKeepalive" yaml:"tcpKeepalive"`
+	PIDFile                  string              `json:"pidFile" yaml:"pidFile"`
+	User                     string              `json:"user" yaml:"user"`
+	Group                    string              `json:"group" yaml:"group"`
+	HostKey                  string              `json:"hostkey" yaml:"hostkey"`
+	HostKeyPassphraseEnv     string              `json:"hostKeyPassphraseEnv" yaml:"hostKeyPassphraseEnv"`
+	HostKeyData              string              `json:"hostKeyData" yaml:"hostKeyData"`
+	HostKeyEnv               string              `json:"hostKeyEnv" yaml:"hostKeyEnv"`
+	AuthKeys                 string              `json:"authkeys" yaml:"authkeys"`
+	AuthKeysToken            string              `json:"authKeysToken" yaml:"authKeysToken"`
+	StrictAuthKeys           bool                `json:"strictAuthKeys" yaml:"strictAuthKeys"`
+	TrustedCAs               string              `json:"trustedCAs" yaml:"trustedCAs"`
+	DenyKeys                 string              `json:"denyKeys" yaml:"denyKeys"`
+	KnownHosts               string              `json:"knownHosts" yaml:"knownHosts"`
+	Hosts                    []Host              `json:"hosts" yaml:"hosts"`
+	Groups                   map[string][]string `json:"groups" yaml:"groups"`
+	Defaults                 map[string]string   `json:"defaults" yaml:"defaults"`
+	Include                  []string            `json:"include" yaml:"include"`
+	Metrics                  string              `json:"metrics" yaml:"metrics"`
+	MetricsUsernames         bool                `json:"metricsUsernames" yaml:"metricsUsernames"`
+	LogFormat                string              `json:"logFormat" yaml:"logFormat"`
+	LogLevel                 string              `json:"logLevel" yaml:"logLevel"`
+	LogTimeFormat            string              `json:"logTimeFormat" yaml:"logTimeFormat"`
+	LogUTC                   bool                `json:"logUTC" yaml:"logUTC"`
+	LogTarget                string              `json:"logTarget" yaml:"logTarget"`
+	LogFile                  string              `json:"logFile" yaml:"logFile"`
+	SyslogFacility           string              `json:"syslogFacility" yaml:"syslogFacility"`
+	SyslogTag                string              `json:"syslogTag" yaml:"syslogTag"`
+	AuditLog                 string              `json:"auditLog" yaml:"auditLog"`
+	LogMetadata              []string            `json:"logMetadata" yaml:"logMetadata"`
+	ResolveClientNames       bool                `json:"resolveClientNames" yaml:"resolveClientNames"`
+	GeoIPDB                  string              `json:"geoipDB" yaml:"geoipDB"`
+	GeoIPASNDB               string              `json:"geoipASNDB" yaml:"geoipASNDB"`
+	AllowCountries           []string            `json:"allowCountries" yaml:"allowCountries"`
+	DenyCountries            []string            `json:"denyCountries" yaml:"denyCountries"`
+	DenyMessage              string              `json:"denyMessage" yaml:"denyMessage"`
+	Motd                     string              `json:"motd" yaml:"motd"`
+	MotdFile                 string              `json:"motdFile" yaml:"motdFile"`
+	UserMotd                 map[string]string   `json:"userMotd" yaml:"userMotd"`
+	NotifyConcurrentSessions bool                `json:"notifyConcurrentSessions" yaml:"notifyConcurrentSessions"`
+	RemoteSort               string              `json:"remoteSort" yaml:"remoteSort"`
+
+	ShutdownTimeout    duration            `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+	IdleTimeout        duration            `json:"idleTimeout" yaml:"idleTimeout"`
+	UserIdleTimeout    map[string]duration `json:"userIdleTimeout" yaml:"userIdleTimeout"`
+	MaxSessionDuration duration            `json:"maxSessionDuration" yaml:"maxSessionDuration"`
+	DialTimeout        duration            `json:"dialTimeout" yaml:"dialTimeout"`
+	DialRetries        int                 `json:"dialRetries" yaml:"dialRetries"`
+	DialRetryBackoff   duration            `json:"dialRetryBackoff" yaml:"dialRetryBackoff"`
+
+	ClientKeepalive    duration `json:"clientKeepalive" yaml:"clientKeepalive"`
+	ClientKeepaliveMax int      `json:"clientKeepaliveMax" yaml:"clientKeepaliveMax"`
+	UpstreamKeepalive  duration `json:"upstreamKeepalive" yaml:"upstreamKeepalive"`
+
+	HealthCheckInterval duration `json:"healthCheckInterval" yaml:"healthCheckInterval"`
+	HeartbeatInterval   duration `json:"heartbeatInterval" yaml:"heartbeatInterval"`
+
+	WebhookURL string `json:"webhookURL" yaml:"webhookURL"`
+
+	AdminAddress string `json:"adminAddress" yaml:"adminAddress"`
+	AdminToken   string `json:"adminToken" yaml:"adminToken"`
+	AdminPersist bool   `json:"adminPersist" yaml:"adminPersist"`
+
+	SessionDumpFile string `json:"sessionDumpFile" yaml:"sessionDumpFile"`
+
+	HostsURL         string   `json:"hostsURL" yaml:"hostsURL"`
+	HostsURLInterval duration `json:"hostsURLInterval" yaml:"hostsURLInterval"`
+
+	MaxConnections         int      `json:"maxConnections" yaml:"maxConnections"`
+	MaxConnectionsPerIP    int      `json:"maxConnectionsPerIP" yaml:"maxConnectionsPerIP"`
+	ConnectionQueue        int      `json:"connectionQueue" yaml:"connectionQueue"`
+	ConnectionQueueTimeout duration `json:"connectionQueueTimeout" yaml:"connectionQueueTimeout"`
+
+	MaxSessionsPerUser   int `json:"maxSessionsPerUser" yaml:"maxSessionsPerUser"`
+	MaxAnonymousSessions int `json:"maxAnonymousSessions" yaml:"maxAnonymousSessions"`
+
+	AuthRateLimit   int      `json:"authRateLimit" yaml:"authRateLimit"`
+	MaxAuthFailures int      `json:"maxAuthFailures" yaml:"maxAuthFailures"`
+	BanWindow       duration `json:"banWindow" yaml:"banWindow"`
+	BanDuration     duration `json:"banDuration" yaml:"banDuration"`
+
+	ProxyProtocol bool `json:"proxyProtocol" yaml:"proxyProtocol"`
+	NoExpandEnv   bool `json:"noExpandEnv" yaml:"noExpandEnv"`
+
+	// authKeysFiles holds the authkeys of every configuration file, in
+	// order, as they are combined rather than overridden.
+	authKeysFiles []string
+}
+
+// duration is a time.Duration that is written as a string such as "30s" or
+// "1h30m" in configuration files.
+type duration time.Duration
+
+func (d *duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	return d.set(s)
+}
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// listenAddresses returns the addresses to listen on.
+func (c *Conf) listenAddresses() []string {
+	var addrs []string
+	if c.Address != "" {
+		addrs = append(addrs, c.Address)
+	}
+	return append(addrs, c.Addresses...)
+}
+
+// host returns the host with the given address, or nil. Addresses rendered
+// from a templated address are matched to their host as well.
+func (c *Conf) host(address string) *Host {
+	for i := range c.Hosts {
+		if c.Hosts[i].Address == address {
+			return &c.Hosts[i]
+		}
+	}
+	for i := range c.Hosts {
+		h := &c.Hosts[i]
+		if h.tmpl == nil {
+			continue
+		}
+		if ok, _ := path.Match(h.match, address); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${var} and $var in the address and path fields with
+// the values of the corresponding environment variables.
+func (c *Conf) expandEnv() {
+	c.Address = os.ExpandEnv(c.Address)
+	for i := range c.Addresses {
+		c.Addresses[i] = os.ExpandEnv(c.Addresses[i])
+	}
+	c.HostKey = os.ExpandEnv(c.HostKey)
+	c.PIDFile = os.ExpandEnv(c.PIDFile)
+	c.AuthKeys = os.ExpandEnv(c.AuthKeys)
+	for i := range c.authKeysFiles {
+		c.authKeysFiles[i] = os.ExpandEnv(c.authKeysFiles[i])
+	}
+	c.TrustedCAs = os.ExpandEnv(c.TrustedCAs)
+	c.DenyKeys = os.ExpandEnv(c.DenyKeys)
+	c.KnownHosts = os.ExpandEnv(c.KnownHosts)
+	c.Metrics = os.ExpandEnv(c.Metrics)
+	c.AdminAddress = os.ExpandEnv(c.AdminAddress)
+	c.AdminToken = os.ExpandEnv(c.AdminToken)
+	c.HostsURL = os.ExpandEnv(c.HostsURL)
+	c.WebhookURL = os.ExpandEnv(c.WebhookURL)
+	c.MotdFile = os.ExpandEnv(c.MotdFile)
+	c.GeoIPDB = os.ExpandEnv(c.GeoIPDB)
+	c.GeoIPASNDB = os.ExpandEnv(c.GeoIPASNDB)
+	c.SessionDumpFile = os.ExpandEnv(c.SessionDumpFile)
+	c.AuditLog = os.ExpandEnv(c.AuditLog)
+	c.LogFile = os.ExpandEnv(c.LogFile)
+	for i := range c.Include {
+		c.Include[i] = os.ExpandEnv(c.Include[i])
+	}
+	for i := range c.Hosts {
+		c.Hosts[i].Address = os.ExpandEnv(c.Hosts[i].Address)
+		c.Hosts[i].FallbackAddress = os.ExpandEnv(c.Hosts[i].FallbackAddress)
+		for j := range c.Hosts[i].Addresses {
+			c.Hosts[i].Addresses[j].Address = os.ExpandEnv(c.Hosts[i].Addresses[j].Address)
+		}
+		c.Hosts[i].KnownHosts = os.ExpandEnv(c.Hosts[i].KnownHosts)
+		c.Hosts[i].Proxy = os.ExpandEnv(c.Hosts[i].Proxy)
+		c.Hosts[i].JumpIdentityFile = os.ExpandEnv(c.Hosts[i].JumpIdentityFile)
+	}
+}
+
+// decodeFile unmarshals a configuration file into v. Files ending in .yaml
+// or .yml are parsed as YAML, files ending in .json or without an extension
+// are parsed as JSON.
+func decodeFile(filename string, v interface{}) error {
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case "", ".json":
+		err = json.Unmarshal(f, v)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(f, v)
+	default:
+		return fmt.Errorf("%s: unknown configuration format %q", filename, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return nil
+}
+
+// mergeFile decodes a configuration file over the configuration read so far.
+// Values set in the file replace the earlier ones, and maps such as groups
+// and defaults are merged key by key. The hosts of the file and its includes
+// are added to the earlier hosts, replacing those with the same address,
+// name or alias, and its authkeys are added to the earlier authkeys.
+func (c *Conf) mergeFile(filename string) error {
+	earlier := c.Hosts
+	c.Hosts, c.Include, c.AuthKeys = nil, nil, ""
+	if err := decodeFile(filename, c); err != nil {
+		return err
+	}
+
+	if err := c.includeHosts(); err != nil {
+		return err
+	}
+	c.Hosts = mergeHosts(earlier, c.Hosts)
+
+	if c.AuthKeys != "" {
+		c.authKeysFiles = append(c.authKeysFiles, c.AuthKeys)
+	} else if n := len(c.authKeysFiles); n > 0 {
+		c.AuthKeys = c.authKeysFiles[n-1]
+	}
+	return nil
+}
+
+// mergeHosts adds hosts to earlier, leaving out the earlier hosts that share
+// an address, name or alias with one of the added hosts.
+func mergeHosts(earlier, hosts []Host) []Host {
+	if len(earlier) == 0 {
+		return hosts
+	}
+
+	replaced := make(map[string]bool)
+	for _, h := range hosts {
+		for _, t := range h.targets() {
+			replaced[t] = true
+		}
+	}
+
+	var res []Host
+	for _, h := range earlier {
+		keep := true
+		for _, t := range h.targets() {
+			if replaced[t] {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, h)
+		}
+	}
+	return append(res, hosts...)
+}
+
+// includeHosts appends the hosts of every file matched by the include
+// patterns to the host list.
+func (c *Conf) includeHosts() error {
+	seen := make(map[string]bool)
+	for _, h := range c.Hosts {
+		seen[h.Address] = true
+	}
+
+	for _, pattern := range c.Include {
+		// The included hosts are read right away, so the pattern cannot
+		// wait for expandEnv.
+		if !c.NoExpandEnv {
+			pattern = os.ExpandEnv(pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("include %q: %v", pattern, err)
+		}
+
+		for _, filename := range matches {
+			var inc struct {
+				Hosts []Host `json:"hosts" yaml:"hosts"`
+			}
+			if err := decodeFile(filename, &inc); err != nil {
+				return err
+			}
+
+			for _, h := range inc.Hosts {
+				if seen[h.Address] {
+					logger.Log("config", fields{"file": filename, "target": h.Address},
+						"%s: duplicate host %s", filename, h.Address)
+				}
+				seen[h.Address] = true
+			}
+			c.Hosts = append(c.Hosts, inc.Hosts...)
+		}
+	}
+
+	return nil
+}
+
+// parseConf reads and merges the given configuration files, in order.
+func parseConf(filenames ...string) (*Conf, error) {
+	c := &Conf{}
+	var include []string
+	for _, filename := range filenames {
+		if err := c.mergeFile(filename); err != nil {
+			return nil, err
+		}
+		include = append(include, c.Include...)
+	}
+	c.Include = include
+
+	if !c.NoExpandEnv {
+		c.expandEnv()
+	}
+
+	if c.MaxAuthFailures > 0 && (c.BanWindow <= 0 || c.BanDuration <= 0) {
+		return nil, errors.New("maxAuthFailures requires banWindow and banDuration")
+	}
+
+	switch c.RemoteSort {
+	case "", "name", "address", "config":
+	default:
+		return nil, fmt.Errorf("unknown remoteSort %q, must be name, address or config", c.RemoteSort)
+	}
+
+	if c.AdminAddress != "" && c.AdminToken == "" {
+		return nil, errors.New("adminAddress requires adminToken")
+	}
+
+	for i := range c.Hosts {
+		if err := c.Hosts[i].resolve(c.Groups); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncludeExpandsEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SSHMUXD_HOSTS_DIR", dir)
+	t.Setenv("SSHMUXD_DOMAIN", "example.com")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"hosts": [{"address": "a.${SSHMUXD_DOMAIN}:22", "users": ["*"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := parseTestConf(t, `{"include": ["${SSHMUXD_HOSTS_DIR}/*.json"]}`)
+	if c.host("a.example.com:22") == nil {
+		t.Fatalf("included host missing, hosts are %v", c.Hosts)
+	}
+	if want := filepath.Join(dir, "*.json"); len(c.Include) != 1 || c.Include[0] != want {
+		t.Fatalf("include is %v, want [%s]", c.Include, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimit caps the number of open connections. Connections beyond the cap
+// may wait in a queue for another connection to close.
+type connLimit struct {
+	mu      sync.Mutex
+	open    int
+	waiting []chan struct{}
+}
+
+// acquire takes a slot for a new connection. If all max slots are taken, it
+// waits up to timeout for one to be released, unless queue connections are
+// waiting already. A max of zero or less means no limit.
+func (l *connLimit) acquire(max, queue int, timeout time.Duration) bool {
+	l.mu.Lock()
+	if max <= 0 || l.open < max {
+		l.open++
+		l.mu.Unlock()
+		return true
+	}
+	if timeout <= 0 || len(l.waiting) >= queue {
+		l.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	l.waiting = append(l.waiting, ch)
+	queuedConnections.Inc()
+	l.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+		return true
+	case <-t.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiting {
+		if w == ch {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			queuedConnections.Dec()
+			return false
+		}
+	}
+	// The slot was handed over as the timer fired.
+	return true
+}
+
+// release gives up a slot, handing it to the connection waiting longest.
+func (l *connLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		queuedConnections.Dec()
+		return
+	}
+	l.open--
+}
+
+// limitListener wraps a net.Listener, only returning connections once they
+// have acquired a slot of the connection limit. Waiting happens in the
+// background, so that queued connections do not hold up Accept.
+type limitListener struct {
+	net.Listener
+	limit  *connLimit
+	params func() (max, queue int, timeout time.Duration)
+	conns  chan net.Conn
+	err    chan error
+}
+
+func newLimitListener(l net.Listener, limit *connLimit, params func() (int, int, time.Duration)) *limitListener {
+	ll := &limitListener{
+		Listener: l,
+		limit:    limit,
+		params:   params,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+	}
+	go ll.acceptLoop()
+	return ll
+}
+
+func (l *limitListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+
+		go func() {
+			max, queue, timeout := l.params()
+			if !l.limit.acquire(max, queue, timeout) {
+				logger.Log("connection_limit", fields{"remote_addr": c.RemoteAddr().String()},
+					"%s: rejecting connection, %d connections open", c.RemoteAddr(), max)
+				c.Close()
+				return
+			}
+			l.conns <- &limitedConn{Conn: c, limit: l.limit}
+		}()
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// Keep the error around for later calls.
+		l.err <- err
+		return nil, err
+	}
+}
+
+// limitedConn is a connection holding a slot of a connection limit, which is
+// released when it is closed.
+type limitedConn struct {
+	net.Conn
+	limit *connLimit
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.limit.release)
+	return err
+}
+
+// ipCounter counts the open connections of each client IP address.
+type ipCounter struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func newIPCounter() *ipCounter {
+	return &ipCounter{n: make(map[string]int)}
+}
+
+// acquire counts a new connection from ip, unless ip already has max
+// connections open. A max of zero or less means no limit.
+func (c *ipCounter) acquire(ip string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.n[ip] >= max {
+		return false
+	}
+	c.n[ip]++
+	return true
+}
+
+func (c *ipCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n[ip]--; c.n[ip] <= 0 {
+		delete(c.n, ip)
+	}
+}
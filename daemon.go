@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joushou/sshmux"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// daemon holds the runtime state shared by the sshmux callbacks.
+type daemon struct {
+	current atomic.Value // *state
+
+	// filenames are the configuration files. The admin API writes to the
+	// last one.
+	filenames []string
+
+	// mu guards base and fetched, which current is built from.
+	mu      sync.Mutex
+	base    *state
+	fetched []Host
+
+	sessions *sessionRegistry
+	conns    connCounter
+	slots    connLimit
+	perIP    *ipCounter
+	limiter  *rateLimiter
+	bans     *banList
+	health   *healthChecker
+	webhook  *webhook
+
+	started  time.Time
+	served   uint64 // sessions connected to a remote host, accessed atomically
+	draining int32  // accessed atomically
+}
+
+func newDaemon(filenames []string, st *state) *daemon {
+	d := &daemon{
+		filenames: filenames,
+		sessions:  newSessionRegistry(),
+		perIP:     newIPCounter(),
+		limiter:   newRateLimiter(),
+		bans:      newBanList(),
+		health:    newHealthChecker(),
+		webhook:   newWebhook(),
+		started:   time.Now(),
+	}
+	d.base = st
+	d.current.Store(st)
+	return d
+}
+
+// reload reads the configuration files again.
+func (d *daemon) reload(filenames []string) error {
+	st, err := loadState(filenames)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old, oldFetched := d.base, d.fetched
+	d.base = st
+	if st.conf.HostsURL == "" {
+		// hostsURL was removed, and its hosts go with it.
+		d.fetched = nil
+	}
+	if err := d.rebuild(); err != nil {
+		d.base, d.fetched = old, oldFetched
+		return err
+	}
+	return nil
+}
+
+// setFetched replaces the hosts fetched from hostsURL.
+func (d *daemon) setFetched(hosts []Host) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	old := d.fetched
+	d.fetched = hosts
+	if err := d.rebuild(); err != nil {
+		d.fetched = old
+		return err
+	}
+	return nil
+}
+
+// rebuild makes the configuration file, extended by the fetched hosts, the
+// current state. d.mu must be held.
+func (d *daemon) rebuild() error {
+	if len(d.fetched) == 0 {
+		d.current.Store(d.base)
+		return nil
+	}
+
+	c := *d.base.conf
+	c.Hosts = append(append([]Host(nil), d.base.conf.Hosts...), d.fetched...)
+	for i := len(d.base.conf.Hosts); i < len(c.Hosts); i++ {
+		if err := c.Hosts[i].resolve(c.Groups); err != nil {
+			return err
+		}
+	}
+
+	st, err := newState(&c, d.base.users)
+	if err != nil {
+		return err
+	}
+	st.cas = d.base.cas
+	st.denied = d.base.denied
+	d.current.Store(st)
+	return nil
+}
+
+// state returns the current configuration.
+func (d *daemon) state() *state {
+	return d.current.Load().(*state)
+}
+
+// housekeeping periodically forgets stale rate limiter, ban list, client
+// name and location entries. It does not return.
+func (d *daemon) housekeeping() {
+	for range time.Tick(time.Minute) {
+		d.limiter.cleanup(time.Minute)
+		clientNames.cleanup()
+		geo.cleanup()
+		for _, ip := range d.bans.cleanup(time.Duration(d.state().conf.BanWindow)) {
+			logger.Log("unban", fields{"remote_ip": ip}, "%s: ban lifted", ip)
+		}
+	}
+}
+
+// logBans logs the currently banned addresses, whatever the log level.
+func (d *daemon) logBans() {
+	banned := d.bans.list()
+	logger.write(levelError, "ban_list", fields{"count": len(banned)}, "%d banned addresses", len(banned))
+	for ip, until := range banned {
+		logger.write(levelError, "ban_list", fields{"remote_ip": ip, "until": until.Format(time.RFC3339)},
+			"%s: banned until %s", ip, until.Format(time.RFC3339))
+	}
+}
+
+// dumpSessions writes the open sessions as JSON to sessionDumpFile, or to
+// stderr if it is not set.
+func (d *daemon) dumpSessions() error {
+	b, err := json.MarshalIndent(d.sessions.describeAll(), "", "\t")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path := d.state().conf.SessionDumpFile; path != "" {
+		return ioutil.WriteFile(path, b, 0600)
+	}
+	_, err = os.Stderr.Write(b)
+	return err
+}
+
+func (d *daemon) auth(c ssh.ConnMetadata, key ssh.PublicKey) (u *sshmux.User, err error) {
+	st := d.state()
+	fp := ssh.FingerprintSHA256(key)
+
+	// Clients offer their keys one after the other, so rejected keys only
+	// count as a failure if the connection never authenticates.
+	defer func() {
+		if err == nil {
+			d.sessions.setAuthFailed(c.RemoteAddr(), false)
+		}
+	}()
+
+	unix := isUnixPeer(c.RemoteAddr())
+
+	allow := func() bool { return d.limiter.allow(remoteIP(c.RemoteAddr()), st.conf.AuthRateLimit) }
+	if st.conf.AuthRateLimit > 0 && !unix && d.sessions.throttled(c.RemoteAddr(), allow) {
+		authentications.WithLabelValues("throttled").Inc()
+		logger.Log("auth_throttled", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "fingerprint": fp},
+			"%s: too many authentication attempts (username: %s)", c.RemoteAddr(), c.User())
+		return nil, errors.New("too many authentication attempts")
+	}
+
+	if st.isDenied(key) {
+		authentications.WithLabelValues("failure").Inc()
+		logger.Log("auth_revoked", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "fingerprint": fp},
+			"%s: revoked key %s (username: %s)", c.RemoteAddr(), fp, c.User())
+		return nil, errors.New("access denied")
+	}
+
+	if e, ok := st.keys[keyID(key)]; ok {
+		if e.command != "" {
+			authentications.WithLabelValues("failure").Inc()
+			logger.Log("auth_denied", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "username": e.user.Name, "fingerprint": fp},
+				"%s: %s has a command= option, which cannot be enforced (username: %s, key: %s)", c.RemoteAddr(), e.user.Name, c.User(), fp)
+			return nil, errors.New("access denied")
+		}
+		if e.permitsSource(c.RemoteAddr()) {
+			authentications.WithLabelValues("success").Inc()
+			return e.user, nil
+		}
+		authentications.WithLabelValues("failure").Inc()
+		logger.Log("auth_denied", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "username": e.user.Name, "fingerprint": fp},
+			"%s: %s not permitted from this address (username: %s, key: %s)", c.RemoteAddr(), e.user.Name, c.User(), fp)
+		return nil, errors.New("access denied")
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok && len(st.cas) > 0 {
+		u, err := st.checkCert(c, cert)
+		if err == nil {
+			authentications.WithLabelValues("success").Inc()
+			return u, nil
+		}
+		logger.Log("cert_rejected", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "fingerprint": fp, "error": err.Error()},
+			"%s: certificate rejected (username: %s, key: %s): %v", c.RemoteAddr(), c.User(), fp, err)
+	}
+
+	if st.hasDefaults && st.allowsAnonymous(c.RemoteAddr()) {
+		authentications.WithLabelValues("success").Inc()
+		return nil, nil
+	}
+
+	authentications.WithLabelValues("failure").Inc()
+	logger.Log("auth_denied", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User(), "fingerprint": fp},
+		"%s: access denied (username: %s, key: %s)", c.RemoteAddr(), c.User(), fp)
+
+	d.sessions.setAuthFailed(c.RemoteAddr(), true)
+	return nil, errors.New("access denied")
+}
+
+// authFailed counts a connection from addr that failed to authenticate
+// towards maxAuthFailures, banning the address once it is reached.
+func (d *daemon) authFailed(addr net.Addr) {
+	st := d.state()
+	n := st.conf.MaxAuthFailures
+	if n <= 0 || isUnixPeer(addr) {
+		return
+	}
+	ip := remoteIP(addr)
+	if d.bans.fail(ip, n, time.Duration(st.conf.BanWindow), time.Duration(st.conf.BanDuration)) {
+		logger.Log("ban", fields{"remote_ip": ip}, "%s: banned for %v after %d failed authentications",
+			ip, time.Duration(st.conf.BanDuration), n)
+	}
+}
+
+func (d *daemon) setup(session *sshmux.Session) error {
+	st := d.state()
+
+	var username string
+	if session.User != nil {
+		username = session.User.Name
+	} else {
+		username = "unknown user"
+	}
+	max := st.conf.MaxSessionsPerUser
+	if session.User == nil {
+		max = st.conf.MaxAnonymousSessions
+	}
+	if !d.sessions.setUserLimited(session.Conn.RemoteAddr(), username, session.Conn.User(), max) {
+		logger.Log("session_limit", sessionFields(session),
+			"%s: %s already has %d sessions open (username: %s)", session.Conn.RemoteAddr(), username, max, session.Conn.User())
+		return fmt.Errorf("too many sessions for %s", username)
+	}
+	f := st.withMetadata(session, sessionFields(session))
+	if session.User != nil {
+		logger.Log("authorized", f, "%s: %s authorized (username: %s, key: %s)",
+			session.Conn.RemoteAddr(), username, session.Conn.User(), ssh.FingerprintSHA256(session.User.PublicKey))
+	} else {
+		logger.Log("authorized", f, "%s: anonymous user authorized for noAuth hosts (username: %s)",
+			session.Conn.RemoteAddr(), session.Conn.User())
+	}
+	d.webhook.notify("authorized", f)
+
+	if t, ok := st.conf.UserIdleTimeout[username]; ok && session.User != nil {
+		d.sessions.setIdleTimeout(session.Conn.RemoteAddr(), time.Duration(t))
+	}
+
+	if t := time.Duration(st.conf.ClientKeepalive); t > 0 {
+		max := st.conf.ClientKeepaliveMax
+		if max <= 0 {
+			max = defaultKeepaliveMax
+		}
+		if s := d.sessions.get(session.Conn.RemoteAddr()); s != nil {
+			go keepalive(session, s.conn, t, max)
+		}
+	}
+
+	now := time.Now()
+
+	var entry *authEntry
+	if session.User != nil {
+		entry = st.keys[keyID(session.User.PublicKey)]
+	}
+
+	var offers []offer
+	for _, h := range st.conf.Hosts {
+		if !h.grants(session, entry) {
+			continue
+		}
+		address, err := h.render(session.User)
+		if err != nil {
+			continue
+		}
+		if entry != nil && !entry.permitsRemote(address) {
+			continue
+		}
+		if st.conf.HealthCheckInterval > 0 && !d.health.healthy(h.Address) {
+			continue
+		}
+		if !h.open(now) {
+			continue
+		}
+		o := offer{name: h.Name, address: address, targets: []string{address}}
+		if h.tmpl == nil {
+			// The names and aliases are listed as well, so that clients
+			// may ask for them with "ssh -W".
+			o.targets = h.targets()
+		}
+		offers = append(offers, o)
+	}
+
+	sortOffers(offers, st.conf.RemoteSort)
+	seen := make(map[string]bool)
+	for _, o := range offers {
+		for _, t := range o.targets {
+			if !seen[t] {
+				seen[t] = true
+				session.Remotes = append(session.Remotes, t)
+			}
+		}
+	}
+
+	// sshmux only calls interactive, which shows the confirmation prompt,
+	// when there is more than one remote to pick from. A single host with a
+	// prompt is therefore listed twice, which the menu shows as one.
+	if len(session.Remotes) == 1 {
+		if h := st.conf.host(st.canonical(session.Remotes[0])); h != nil && h.ConfirmPrompt != "" {
+			session.Remotes = append(session.Remotes, session.Remotes[0])
+		}
+	}
+
+	if len(session.Remotes) == 0 && st.conf.DenyMessage != "" {
+		logger.Log("no_remotes", sessionFields(session), "%s: %s has no permitted hosts", session.Conn.RemoteAddr(), username)
+		return errors.New(st.conf.DenyMessage)
+	}
+	return nil
+}
+
+// offer is a host offered to a session, with what it may be asked for by.
+type offer struct {
+	name    string
+	address string
+	targets []string
+}
+
+// sortOffers orders the offered hosts according to remoteSort: by name,
+// falling back to the address for hosts without one, by address, or in the
+// order of the configuration.
+func sortOffers(offers []offer, mode string) {
+	key := func(o offer) string {
+		if o.name != "" {
+			return o.name
+		}
+		return o.address
+	}
+	switch mode {
+	case "address":
+		key = func(o offer) string { return o.address }
+	case "config":
+		return
+	}
+	sort.SliceStable(offers, func(i, j int) bool { return key(offers[i]) < key(offers[j]) })
+}
+
+func (d *daemon) selected(session *sshmux.Session, remote string) error {
+	st := d.state()
+	remote = st.canonical(remote)
+
+	var username string
+	if session.User != nil {
+		username = session.User.Name
+	} else {
+		username = "unknown user"
+	}
+	f := st.withMetadata(session, sessionFields(session))
+	f["target"] = remote
+
+	h := st.conf.host(remote)
+	err := st.checkSelected(session, remote, h)
+	if err == nil && h.ConfirmPrompt != "" && !d.sessions.confirmed(session.Conn.RemoteAddr(), remote) {
+		err = fmt.Errorf("%s requires confirmation, which is only asked for in the menu", remote)
+	}
+	if err == nil && !d.sessions.setTargetLimited(session.Conn.RemoteAddr(), remote, h.MaxConnections) {
+		err = fmt.Errorf("%s has too many connections", remote)
+	}
+	if err != nil {
+		f["error"] = err.Error()
+		logger.Log("selection_denied", f, "%s: %s denied access to %s: %v", session.Conn.RemoteAddr(), username, remote, err)
+		return err
+	}
+
+	atomic.AddUint64(&d.served, 1)
+	logger.Log("connecting", f, "%s: %s connecting to %s", session.Conn.RemoteAddr(), username, remote)
+	d.webhook.notify("connecting", f)
+	remoteConnections.WithLabelValues(remote).Inc()
+
+	limit := st.conf.MaxSessionDuration
+	if h != nil && h.MaxSessionDuration != 0 {
+		limit = h.MaxSessionDuration
+	}
+	if limit > 0 {
+		t := time.Duration(limit)
+		d.sessions.limitDuration(session.Conn.RemoteAddr(), t, func(s *sessionInfo) {
+			logger.Log("session_expired", s.describe(), "%s: closing session to %s after %v", session.Conn.RemoteAddr(), remote, t)
+		})
+	}
+	return nil
+}
+
+// withMetadata adds the metadata of the session's authkeys entry named by
+// logMetadata to f, as the "metadata" field.
+func (st *state) withMetadata(session *sshmux.Session, f fields) fields {
+	if session.User == nil || len(st.conf.LogMetadata) == 0 {
+		return f
+	}
+	e := st.keys[keyID(session.User.PublicKey)]
+	if e == nil {
+		return f
+	}
+
+	m := make(map[string]string)
+	for _, k := range st.conf.LogMetadata {
+		if v, ok := e.metadata[k]; ok {
+			m[k] = v
+		}
+	}
+	if len(m) > 0 {
+		f["metadata"] = m
+	}
+	return f
+}
+
+// allowsAnonymous reports whether any noAuth host may be accessed without
+// authentication from addr.
+func (st *state) allowsAnonymous(addr net.Addr) bool {
+	for i := range st.conf.Hosts {
+		if st.conf.Hosts[i].noAuthFor(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDenied reports whether a key is listed in denyKeys. For certificates,
+// both the certificate and the key it certifies are checked.
+func (st *state) isDenied(key ssh.PublicKey) bool {
+	if st.denied[keyID(key)] {
+		return true
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return st.denied[keyID(cert.Key)]
+	}
+	return false
+}
+
+// checkSelected decides whether a session may connect to the remote host it
+// selected, returning the reason if not. The configuration may have been
+// reloaded since the session was set up, so the permissions are checked
+// again.
+func (st *state) checkSelected(session *sshmux.Session, remote string, h *Host) error {
+	if h == nil {
+		return fmt.Errorf("%s is no longer available", remote)
+	}
+	var entry *authEntry
+	if session.User != nil {
+		entry = st.keys[keyID(session.User.PublicKey)]
+	}
+	if !h.grants(session, entry) {
+		return fmt.Errorf("%s may no longer be accessed", remote)
+	}
+	if address, err := h.render(session.User); err != nil || address != remote {
+		return fmt.Errorf("%s may not be accessed by this user", remote)
+	}
+	if !h.open(time.Now()) {
+		return fmt.Errorf("%s may not be accessed at this time", remote)
+	}
+	return nil
+}
+
+// checkCert validates a user certificate against the trusted CAs. The
+// username of the connection must be one of the principals of the
+// certificate, and is used as the name of the user.
+func (st *state) checkCert(c ssh.ConnMetadata, cert *ssh.Certificate) (*sshmux.User, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return st.cas[keyID(auth)]
+		},
+	}
+	if _, err := checker.Authenticate(c, cert); err != nil {
+		return nil, err
+	}
+
+	return &sshmux.User{
+		PublicKey: cert,
+		Name:      c.User(),
+	}, nil
+}
+
+// dial connects to the selected remote host. The error is what sshmux reports
+// to the client, so it names the target and the reason, without the details
+// that are logged.
+func (d *daemon) dial(network, address string) (net.Conn, error) {
+	st := d.state()
+	conn, err := st.dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %s", st.canonical(address), dialReason(err))
+	}
+	return conn, nil
+}
+
+// dialReason returns the short reason for a failed connection, such as
+// "connection refused".
+func dialReason(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "connection timed out"
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err.Error()
+}
+
+// limit wraps a listener, so that the connections accepted from it count
+// towards maxConnections.
+func (d *daemon) limit(l net.Listener) net.Listener {
+	return newLimitListener(l, &d.slots, func() (int, int, time.Duration) {
+		c := d.state().conf
+		return c.MaxConnections, c.ConnectionQueue, time.Duration(c.ConnectionQueueTimeout)
+	})
+}
+
+// filter wraps a listener, so that connections that are not let in, such as
+// those of banned addresses, are closed as soon as they are accepted. It
+// goes inside limit, so that these connections never take a slot.
+func (d *daemon) filter(l net.Listener) net.Listener {
+	return &filterListener{
+		Listener: l,
+		filter: func(conn net.Conn) bool {
+			if d.isDraining() {
+				logger.Log("draining", fields{"remote_addr": conn.RemoteAddr().String()},
+					"%s: rejecting connection while draining", conn.RemoteAddr())
+				return false
+			}
+			if isUnixPeer(conn.RemoteAddr()) {
+				return true
+			}
+			ip := remoteIP(conn.RemoteAddr())
+			if d.bans.isBanned(ip) {
+				return false
+			}
+			if geo.enabled() {
+				g := geo.lookup(ip)
+				if !d.state().conf.countryAllowed(g.country) {
+					country := g.country
+					if country == "" {
+						country = "unknown"
+					}
+					logger.Log("geoip_blocked", fields{"remote_addr": conn.RemoteAddr().String(), "remote_ip": ip, "country": country},
+						"%s: rejecting connection from country %s", conn.RemoteAddr(), country)
+					return false
+				}
+			}
+			if n := d.state().conf.MaxConnectionsPerIP; !d.perIP.acquire(ip, n) {
+				logger.Log("connection_limit", fields{"remote_addr": conn.RemoteAddr().String(), "remote_ip": ip},
+					"%s: rejecting connection, %d connections open from %s", conn.RemoteAddr(), n, ip)
+				return false
+			}
+			return true
+		},
+		onClose: func(conn net.Conn) {
+			if !isUnixPeer(conn.RemoteAddr()) {
+				d.perIP.release(remoteIP(conn.RemoteAddr()))
+			}
+		},
+	}
+}
+
+// track wraps a listener, so that the connections accepted from it are
+// tracked by the daemon.
+func (d *daemon) track(l net.Listener) net.Listener {
+	return &trackingListener{
+		Listener: l,
+		onOpen: func(tc *trackedConn) {
+			d.conns.open()
+			if _, ok := tc.RemoteAddr().(*net.TCPAddr); ok && d.state().conf.ResolveClientNames {
+				clientNames.lookup(remoteIP(tc.RemoteAddr()))
+			}
+			s := d.sessions.add(tc)
+			logger.Log("connect", s.describe(), "%s: new connection", tc.RemoteAddr())
+			d.webhook.notify("connect", s.describe())
+
+			if t := time.Duration(d.state().conf.IdleTimeout); t > 0 {
+				tc.closeWhenIdle(t, s.idleClosed)
+			}
+		},
+		onClose: func(tc *trackedConn) {
+			if s := d.sessions.get(tc.RemoteAddr()); s != nil {
+				f := s.describe()
+				in, out := atomic.LoadInt64(&tc.bytesIn), atomic.LoadInt64(&tc.bytesOut)
+				dur := time.Since(s.start).Truncate(time.Second)
+				observeSession(d.state().conf, s, in, out, time.Since(s.start))
+				f["bytes_in"], f["bytes_out"], f["duration"] = in, out, dur.String()
+				logger.Log("disconnect", f, "%s: connection closed after %v, %d bytes in, %d bytes out", tc.RemoteAddr(), dur, in, out)
+				d.webhook.notify("disconnect", f)
+				if s.failedAuth() {
+					d.authFailed(tc.RemoteAddr())
+				}
+			}
+			d.sessions.remove(tc)
+			d.conns.close()
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joushou/sshmux"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConn is the connection metadata of a client authenticating.
+type testConn struct {
+	user   string
+	remote net.Addr
+}
+
+func (c testConn) User() string          { return c.user }
+func (c testConn) SessionID() []byte     { return nil }
+func (c testConn) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (c testConn) ServerVersion() []byte { return []byte("SSH-2.0-sshmuxd") }
+func (c testConn) RemoteAddr() net.Addr  { return c.remote }
+func (c testConn) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22} }
+
+// testUsers returns n users with generated ed25519 keys.
+func testUsers(tb testing.TB, n int) []*authEntry {
+	users := make([]*authEntry, n)
+	for i := range users {
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pk, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		users[i] = &authEntry{user: &sshmux.User{PublicKey: pk, Name: fmt.Sprintf("user%d", i)}}
+	}
+	return users
+}
+
+// scanUsers is the linear search auth used before keys were looked up in a
+// map, for comparison.
+func scanUsers(users []*authEntry, key ssh.PublicKey) *authEntry {
+	b := key.Marshal()
+	for _, e := range users {
+		if bytes.Equal(e.user.PublicKey.Marshal(), b) {
+			return e
+		}
+	}
+	return nil
+}
+
+func BenchmarkAuth(b *testing.B) {
+	c := testConn{user: "me", remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}}
+
+	for _, n := range []int{10000, 50000} {
+		users := testUsers(b, n)
+		st, err := newState(&Conf{}, users)
+		if err != nil {
+			b.Fatal(err)
+		}
+		d := newDaemon(nil, st)
+
+		// The last key is the worst case for a linear search.
+		key := users[n-1].user.PublicKey
+
+		b.Run(fmt.Sprintf("map/%dk", n/1000), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if u, err := d.auth(c, key); err != nil || u == nil {
+					b.Fatalf("auth failed: %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("scan/%dk", n/1000), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if scanUsers(users, key) == nil {
+					b.Fatal("key not found")
+				}
+			}
+		})
+	}
+}
+
+// acceptTest accepts a connection from ip through d's tracking, as sshmux
+// would see it.
+func acceptTest(t *testing.T, d *daemon, ip string) net.Conn {
+	tl := &testListener{conns: make(chan net.Conn, 1)}
+	tl.conns <- newPeerConn(ip)
+	c, err := d.track(tl).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBanCountsConnections(t *testing.T) {
+	users := testUsers(t, 1)
+	st, err := newState(&Conf{
+		MaxAuthFailures: 3,
+		BanWindow:       duration(time.Minute),
+		BanDuration:     duration(time.Hour),
+	}, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+	keys := testUsers(t, 5)
+
+	// Keys offered before the accepted one do not count at all.
+	for i := 0; i < 3; i++ {
+		c := acceptTest(t, d, "192.0.2.1")
+		meta := testConn{user: "me", remote: c.RemoteAddr()}
+		d.auth(meta, keys[0].user.PublicKey)
+		if _, err := d.auth(meta, users[0].user.PublicKey); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if d.bans.isBanned("192.0.2.1") {
+		t.Fatal("banned after authenticating")
+	}
+
+	// A client offering several keys before the one that is accepted, or
+	// before giving up, fails once.
+	c := acceptTest(t, d, "192.0.2.1")
+	for _, e := range keys {
+		if _, err := d.auth(testConn{user: "me", remote: c.RemoteAddr()}, e.user.PublicKey); err == nil {
+			t.Fatal("unknown key accepted")
+		}
+	}
+	c.Close()
+	if d.bans.isBanned("192.0.2.1") {
+		t.Fatal("banned after one connection offering several keys")
+	}
+
+	for i := 0; i < 2; i++ {
+		c := acceptTest(t, d, "192.0.2.1")
+		d.auth(testConn{user: "me", remote: c.RemoteAddr()}, keys[0].user.PublicKey)
+		c.Close()
+	}
+	if !d.bans.isBanned("192.0.2.1") {
+		t.Fatal("not banned after three failed connections")
+	}
+}
+
+func TestAuthRateLimitPerConnection(t *testing.T) {
+	users := testUsers(t, 1)
+	st, err := newState(&Conf{AuthRateLimit: 1}, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+
+	// The client offers its other keys first.
+	c := acceptTest(t, d, "192.0.2.1")
+	meta := testConn{user: "me", remote: c.RemoteAddr()}
+	for _, e := range testUsers(t, 5) {
+		d.auth(meta, e.user.PublicKey)
+	}
+	if _, err := d.auth(meta, users[0].user.PublicKey); err != nil {
+		t.Fatalf("throttled within a single connection: %v", err)
+	}
+	c.Close()
+
+	c = acceptTest(t, d, "192.0.2.1")
+	if _, err := d.auth(testConn{user: "me", remote: c.RemoteAddr()}, users[0].user.PublicKey); err == nil {
+		t.Fatal("second connection within the minute not throttled")
+	}
+	c.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var drainingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sshmuxd_draining",
+	Help: "Whether new connections are refused for maintenance (1) or not (0).",
+})
+
+func init() {
+	prometheus.MustRegister(drainingGauge)
+}
+
+// setDraining starts or stops draining. While draining, new connections are
+// closed right away, and open sessions continue.
+func (d *daemon) setDraining(on bool, by string) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.draining, v) == v {
+		return
+	}
+	drainingGauge.Set(float64(v))
+
+	n := d.conns.count()
+	if on {
+		logger.Log("drain", fields{"draining": true, "by": by, "active_sessions": n},
+			"draining on request of %s, refusing new connections, %d sessions open", by, n)
+	} else {
+		logger.Log("drain", fields{"draining": false, "by": by, "active_sessions": n},
+			"draining stopped on request of %s, accepting connections again", by)
+	}
+}
+
+// isDraining reports whether new connections are refused.
+func (d *daemon) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// adminDrain reports the drain state on GET, starts draining on POST and
+// stops it on DELETE.
+func (d *daemon) adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		d.setDraining(true, r.RemoteAddr)
+	case "DELETE":
+		d.setDraining(false, r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"draining":        d.isDraining(),
+		"active_sessions": d.conns.count(),
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPTTL is how long the location of a client address is kept.
+const geoIPTTL = 10 * time.Minute
+
+// geoInfo is the location of a client address.
+type geoInfo struct {
+	country string
+	asn     uint
+	org     string
+	expires time.Time
+}
+
+// geoResolver looks up client addresses in MaxMind databases, such as
+// GeoLite2-Country and GeoLite2-ASN, and caches the results.
+type geoResolver struct {
+	mu      sync.Mutex
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+	entries map[string]*geoInfo
+}
+
+var geo = &geoResolver{entries: make(map[string]*geoInfo)}
+
+// openGeoDB reads a MaxMind database into memory. Nothing is opened if
+// filename is empty.
+func openGeoDB(filename string) (*maxminddb.Reader, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return maxminddb.FromBytes(b)
+}
+
+// load replaces the databases, and forgets the cached locations.
+func (g *geoResolver) load(countryDB, asnDB string) error {
+	country, err := openGeoDB(countryDB)
+	if err != nil {
+		return fmt.Errorf("geoipDB: %v", err)
+	}
+	asn, err := openGeoDB(asnDB)
+	if err != nil {
+		return fmt.Errorf("geoipASNDB: %v", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.country, g.asn = country, asn
+	g.entries = make(map[string]*geoInfo)
+	return nil
+}
+
+// lookup returns the location of ip. It is empty if no database is loaded,
+// or the address is not in it.
+func (g *geoResolver) lookup(ip string) geoInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.country == nil && g.asn == nil {
+		return geoInfo{}
+	}
+	if e, ok := g.entries[ip]; ok && time.Now().Before(e.expires) {
+		return *e
+	}
+
+	e := &geoInfo{expires: time.Now().Add(geoIPTTL)}
+	if addr := net.ParseIP(ip); addr != nil {
+		if g.country != nil {
+			var rec struct {
+				Country struct {
+					ISOCode string `maxminddb:"iso_code"`
+				} `maxminddb:"country"`
+			}
+			if err := g.country.Lookup(addr, &rec); err == nil {
+				e.country = rec.Country.ISOCode
+			}
+		}
+		if g.asn != nil {
+			var rec struct {
+				ASN uint   `maxminddb:"autonomous_system_number"`
+				Org string `maxminddb:"autonomous_system_organization"`
+			}
+			if err := g.asn.Lookup(addr, &rec); err == nil {
+				e.asn, e.org = rec.ASN, rec.Org
+			}
+		}
+	}
+	g.entries[ip] = e
+	return *e
+}
+
+// enabled reports whether a database is loaded.
+func (g *geoResolver) enabled() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.country != nil || g.asn != nil
+}
+
+// addFields adds the cached location of ip to f, if it is known.
+func (g *geoResolver) addFields(ip string, f fields) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e, ok := g.entries[ip]
+	if !ok {
+		return
+	}
+	if e.country != "" {
+		f["country"] = e.country
+	}
+	if e.asn != 0 {
+		f["asn"] = e.asn
+		f["as_org"] = e.org
+	}
+}
+
+// cleanup forgets the expired locations.
+func (g *geoResolver) cleanup() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for ip, e := range g.entries {
+		if now.After(e.expires) {
+			delete(g.entries, ip)
+		}
+	}
+}
+
+// countryAllowed reports whether clients from the country with the given
+// ISO code may connect. Clients of unknown countries have an empty code.
+func (c *Conf) countryAllowed(country string) bool {
+	for _, cc := range c.DenyCountries {
+		if cc == country {
+			return false
+		}
+	}
+	if len(c.AllowCountries) == 0 {
+		return true
+	}
+	for _, cc := range c.AllowCountries {
+		if cc == country {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// healthCheckFailures is the number of consecutive failed checks after which
+// a host is considered down.
+const healthCheckFailures = 3
+
+var hostUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sshmuxd_host_up",
+	Help: "Whether a remote host passed its health checks (1) or not (0).",
+}, []string{"remote"})
+
+func init() {
+	prometheus.MustRegister(hostUp)
+}
+
+// healthChecker periodically connects to every host, and keeps track of
+// which ones are reachable.
+type healthChecker struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{failures: make(map[string]int)}
+}
+
+// healthy reports whether the host with the given address is considered up.
+// Hosts that have not been checked yet are considered up.
+func (hc *healthChecker) healthy(address string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.failures[address] < healthCheckFailures
+}
+
+// run checks all hosts every healthCheckInterval. It does not return.
+func (hc *healthChecker) run(d *daemon) {
+	for {
+		st := d.state()
+		interval := time.Duration(st.conf.HealthCheckInterval)
+		if interval <= 0 {
+			// Disabled, but may be enabled by a reload.
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		hc.checkAll(st)
+		time.Sleep(interval)
+	}
+}
+
+func (hc *healthChecker) checkAll(st *state) {
+	var wg sync.WaitGroup
+	for i := range st.conf.Hosts {
+		h := &st.conf.Hosts[i]
+		if h.tmpl != nil {
+			// There is no single address to check.
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.record(h.Address, st.checkHost(h))
+		}()
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) record(address string, ok bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	before := hc.failures[address] < healthCheckFailures
+	if ok {
+		hc.failures[address] = 0
+	} else {
+		hc.failures[address]++
+	}
+	after := hc.failures[address] < healthCheckFailures
+
+	if after {
+		hostUp.WithLabelValues(address).Set(1)
+	} else {
+		hostUp.WithLabelValues(address).Set(0)
+	}
+
+	if before != after {
+		if after {
+			logger.Log("health", fields{"target": address, "healthy": true}, "%s: host is up", address)
+		} else {
+			logger.Log("health", fields{"target": address, "healthy": false},
+				"%s: host is down after %d failed checks", address, healthCheckFailures)
+		}
+	}
+}
+
+// checkHost reports whether any of the addresses of a host accept TCP
+// connections, made through the proxy and jump hosts of the host, if any,
+// as sessions would.
+func (st *state) checkHost(h *Host) bool {
+	timeout := time.Duration(st.conf.DialTimeout)
+	if h.DialTimeout != 0 {
+		timeout = time.Duration(h.DialTimeout)
+	}
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	addrs := h.backends()
+	if len(h.Addresses) == 0 {
+		addrs = []string{h.Address}
+	}
+	if h.FallbackAddress != "" {
+		addrs = append(addrs[:len(addrs):len(addrs)], h.FallbackAddress)
+	}
+
+	dial, err := st.hostDialer(h, timeout)
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		conn, err := dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
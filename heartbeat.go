@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat periodically logs the number of active sessions, the number of
+// sessions connected to a remote host since startup, and the uptime, until
+// stop is closed.
+func (d *daemon) heartbeat(stop <-chan struct{}) {
+	for {
+		interval := time.Duration(d.state().conf.HeartbeatInterval)
+		wait := interval
+		if interval <= 0 {
+			// Disabled, but may be enabled by a reload.
+			wait = time.Minute
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		d.beat()
+	}
+}
+
+// beat logs a single heartbeat.
+func (d *daemon) beat() {
+	active := d.conns.count()
+	served := atomic.LoadUint64(&d.served)
+	uptime := d.uptime()
+	logger.Log("heartbeat", fields{"active_sessions": active, "sessions_served": served, "uptime": uptime.String()},
+		"alive: %d active sessions, %d served, up %v", active, served, uptime)
+}
+
+// uptime returns how long the daemon has been running, to the second.
+func (d *daemon) uptime() time.Duration {
+	return time.Since(d.started).Truncate(time.Second)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUptime(t *testing.T) {
+	d := newDaemon(nil, &state{conf: &Conf{}})
+	if up := d.uptime(); up < 0 || up > time.Second {
+		t.Fatalf("uptime right after startup is %v", up)
+	}
+
+	d.started = d.started.Add(-90 * time.Second)
+	if up := d.uptime(); up != 90*time.Second {
+		t.Fatalf("uptime is %v, want %v", up, 90*time.Second)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	buf := captureLog(t)
+	c := parseTestConf(t, `{"hosts": [{"address": "ssh1.example.com:22", "users": ["me"]}]}`)
+	users := testUsers(t, 1)
+	users[0].user.Name = "me"
+	st, err := newState(c, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+	d.started = d.started.Add(-90 * time.Second)
+
+	// Of two connections, only one selects a host.
+	testSession(d, nil, "192.0.2.1")
+	d.conns.open()
+	session := testSession(d, users[0].user, "192.0.2.2")
+	d.conns.open()
+	if err := d.setup(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.selected(session, "ssh1.example.com:22"); err != nil {
+		t.Fatal(err)
+	}
+
+	d.beat()
+	recs := loggedEvents(t, buf, "heartbeat")
+	if len(recs) != 1 {
+		t.Fatalf("logged %d heartbeats, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec["active_sessions"] != float64(2) || rec["sessions_served"] != float64(1) || rec["uptime"] != "1m30s" {
+		t.Fatalf("heartbeat is %v", rec)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// readHostKey returns the PEM data of the host key, and a description of
+// where it was read from. The key is taken from hostKeyData, the environment
+// variable named by hostKeyEnv, stdin if hostkey is "-", or the hostkey file,
+// in that order.
+func readHostKey(c *Conf) ([]byte, string, error) {
+	switch {
+	case c.HostKeyData != "":
+		return []byte(c.HostKeyData), "hostKeyData", nil
+	case c.HostKeyEnv != "":
+		source := fmt.Sprintf("environment variable %s", c.HostKeyEnv)
+		v := os.Getenv(c.HostKeyEnv)
+		if v == "" {
+			return nil, source, errors.New("not set")
+		}
+		return []byte(v), source, nil
+	case c.HostKey == "-":
+		b, err := ioutil.ReadAll(os.Stdin)
+		return b, "stdin", err
+	default:
+		b, err := ioutil.ReadFile(c.HostKey)
+		return b, c.HostKey, err
+	}
+}
+
+// loadHostKey reads the host key. If the key is encrypted, the passphrase is
+// taken from the environment variable named by hostKeyPassphraseEnv, or
+// asked for if stdin is a terminal.
+func loadHostKey(c *Conf) (ssh.Signer, error) {
+	b, source, err := readHostKey(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		return signer, nil
+	}
+
+	var passphrase []byte
+	if v := os.Getenv(c.HostKeyPassphraseEnv); c.HostKeyPassphraseEnv != "" && v != "" {
+		passphrase = []byte(v)
+	} else if fd := int(os.Stdin.Fd()); c.HostKey != "-" && term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "Passphrase for %s: ", source)
+		passphrase, err = term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s is encrypted, and no passphrase was given", source)
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(b, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return signer, nil
+}
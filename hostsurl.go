@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultHostsURLInterval is how often hostsURL is fetched, unless
+// configured otherwise.
+const defaultHostsURLInterval = time.Minute
+
+var hostsClient = &http.Client{Timeout: 30 * time.Second}
+
+// pollHosts periodically fetches the hosts from hostsURL. If fetching fails,
+// the hosts fetched last are kept. It does not return.
+func (d *daemon) pollHosts() {
+	var url, etag string
+	for {
+		d.mu.Lock()
+		c := d.base.conf
+		d.mu.Unlock()
+
+		interval := time.Duration(c.HostsURLInterval)
+		if interval <= 0 {
+			interval = defaultHostsURLInterval
+		}
+
+		if c.HostsURL == "" {
+			// Removed by a reload, which also dropped the fetched hosts.
+			url, etag = "", ""
+			time.Sleep(interval)
+			continue
+		}
+		if c.HostsURL != url {
+			// Changed by a reload, so the old ETag does not apply.
+			url, etag = c.HostsURL, ""
+		}
+
+		hosts, tag, err := fetchHosts(url, etag)
+		switch {
+		case err != nil:
+			logger.Log("hosts_url", fields{"url": url, "error": err.Error()},
+				"fetching hosts from %s failed, keeping last known hosts: %v", url, err)
+		case tag == etag && etag != "":
+			// Not modified.
+		default:
+			if err := d.setFetched(hosts); err != nil {
+				logger.Log("hosts_url", fields{"url": url, "error": err.Error()},
+					"hosts from %s rejected, keeping last known hosts: %v", url, err)
+				break
+			}
+			etag = tag
+			logger.Log("hosts_url", fields{"url": url, "count": len(hosts)}, "loaded %d hosts from %s", len(hosts), url)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// fetchHosts fetches a JSON array of hosts. If the server reports that the
+// hosts have not changed since etag, the returned tag equals etag and no
+// hosts are returned.
+func fetchHosts(url, etag string) ([]Host, string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := hostsClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var hosts []Host
+	if err := json.NewDecoder(resp.Body).Decode(&hosts); err != nil {
+		return nil, "", err
+	}
+	return hosts, resp.Header.Get("ETag"), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadWithoutHostsURL(t *testing.T) {
+	dir := t.TempDir()
+	authkeys := filepath.Join(dir, "authkeys")
+	if err := ioutil.WriteFile(authkeys, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(conf string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "conf.json"), []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{filepath.Join(dir, "conf.json")}
+
+	write(`{"authkeys": "` + authkeys + `", "hostsURL": "http://127.0.0.1:1/hosts", "hosts": [{"address": "ssh1.example.com:22", "users": ["*"]}]}`)
+	st, err := loadState(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(files, st)
+	if err := d.setFetched([]Host{{Address: "fetched.example.com:22", Users: []string{"*"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if d.state().conf.host("fetched.example.com:22") == nil {
+		t.Fatal("fetched host missing")
+	}
+
+	// Reloading with hostsURL still set keeps the fetched hosts.
+	if err := d.reload(files); err != nil {
+		t.Fatal(err)
+	}
+	if d.state().conf.host("fetched.example.com:22") == nil {
+		t.Fatal("fetched host dropped by a reload")
+	}
+
+	write(`{"authkeys": "` + authkeys + `", "hosts": [{"address": "ssh1.example.com:22", "users": ["*"]}]}`)
+	if err := d.reload(files); err != nil {
+		t.Fatal(err)
+	}
+	if d.state().conf.host("fetched.example.com:22") != nil {
+		t.Fatal("fetched host kept after removing hostsURL")
+	}
+	if d.state().conf.host("ssh1.example.com:22") == nil {
+		t.Fatal("configured host missing")
+	}
+}
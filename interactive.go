@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joushou/sshmux"
+)
+
+// errSelectionCancelled is returned when the user aborts the host selection.
+var errSelectionCancelled = errors.New("selection cancelled")
+
+// errConfirmationDeclined is returned when the user does not confirm the
+// connection to a host with a confirmation prompt.
+var errConfirmationDeclined = errors.New("connection not confirmed")
+
+// confirmTimeout is how long the user has to answer a confirmation prompt.
+const confirmTimeout = time.Minute
+
+// interactive asks the user to pick one of the permitted remote hosts, and to
+// confirm the choice if the host has a confirmation prompt. sshmux only calls
+// it when there is more than one remote to pick from, but a host with
+// aliases counts as several remotes.
+func (d *daemon) interactive(rw io.ReadWriter, session *sshmux.Session) (string, error) {
+	remote, err := d.pick(rw, session)
+	if err != nil {
+		return "", err
+	}
+	if err := d.confirm(rw, session, remote); err != nil {
+		return "", err
+	}
+	return remote, nil
+}
+
+// pick returns the remote host the user picks.
+func (d *daemon) pick(rw io.ReadWriter, session *sshmux.Session) (string, error) {
+	st := d.state()
+
+	username := "unknown user"
+	if session.User != nil {
+		username = session.User.Name
+	}
+
+	// The remotes include the names and aliases of the hosts, but each
+	// host is listed once. Hidden hosts are not listed, but can be picked
+	// by typing exactly what they may be asked for by.
+	m := &menu{rw: rw, hidden: make(map[string]string)}
+	seen := make(map[string]bool)
+	for _, r := range session.Remotes {
+		c := st.canonical(r)
+		if h := st.conf.host(c); h != nil && h.Hidden {
+			seen[c] = true
+			m.hidden[r] = c
+			if host, _, err := net.SplitHostPort(r); err == nil {
+				m.hidden[host] = c
+			}
+			continue
+		}
+		if !seen[c] {
+			seen[c] = true
+			m.remotes = append(m.remotes, c)
+			m.labels = append(m.labels, st.label(c))
+		}
+	}
+	if len(m.remotes) == 1 && len(m.hidden) == 0 {
+		return m.remotes[0], nil
+	}
+
+	// Users with a default host skip the selection, as long as they are
+	// permitted to access it.
+	if session.User != nil {
+		if def, ok := st.conf.Defaults[session.User.Name]; ok && seen[st.canonical(def)] {
+			return st.canonical(def), nil
+		}
+	}
+
+	if motd := st.motdFor(session.User); motd != "" {
+		writeLines(rw, motd)
+	}
+	fmt.Fprintf(rw, "Welcome to sshmux, %s\r\n", username)
+	if st.conf.NotifyConcurrentSessions && session.User != nil {
+		d.notifyOthers(rw, session)
+	}
+	return m.run()
+}
+
+// notifyOthers tells the user about their other open sessions, if any.
+func (d *daemon) notifyOthers(w io.Writer, session *sshmux.Session) {
+	others := d.sessions.others(session.Conn.RemoteAddr(), session.User.Name)
+	if len(others) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s has %d other sessions open:\r\n", session.User.Name, len(others))
+	for _, s := range others {
+		s.mu.Lock()
+		target := s.target
+		s.mu.Unlock()
+		if target == "" {
+			target = "no host selected yet"
+		}
+		fmt.Fprintf(w, "  from %s since %s (%s)\r\n", remoteIP(s.conn.RemoteAddr()),
+			s.start.Format("2006-01-02 15:04:05"), target)
+	}
+}
+
+// confirm shows the confirmation prompt of the selected host, if it has one,
+// and waits for the user to answer "yes". Other answers, and no answer within
+// confirmTimeout, abort the session.
+func (d *daemon) confirm(rw io.ReadWriter, session *sshmux.Session, remote string) error {
+	st := d.state()
+	h := st.conf.host(remote)
+	if h == nil || h.ConfirmPrompt == "" {
+		return nil
+	}
+
+	writeLines(rw, h.ConfirmPrompt)
+	io.WriteString(rw, "Type yes to continue: ")
+
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := readLine(rw)
+		answer <- line
+	}()
+
+	f := sessionFields(session)
+	f["target"] = remote
+	t := time.NewTimer(confirmTimeout)
+	defer t.Stop()
+	select {
+	case a := <-answer:
+		if strings.EqualFold(strings.TrimSpace(a), "yes") {
+			d.sessions.setConfirmed(session.Conn.RemoteAddr(), remote)
+			logger.Log("confirmed", f, "%s: connection to %s confirmed", session.Conn.RemoteAddr(), remote)
+			return nil
+		}
+		f["reason"] = "declined"
+		logger.Log("confirm_denied", f, "%s: connection to %s declined", session.Conn.RemoteAddr(), remote)
+		return errConfirmationDeclined
+	case <-t.C:
+		io.WriteString(rw, "\r\n")
+		f["reason"] = "timeout"
+		logger.Log("confirm_denied", f, "%s: connection to %s not confirmed within %v", session.Conn.RemoteAddr(), remote, confirmTimeout)
+		return errConfirmationDeclined
+	}
+}
+
+// readLine reads a line typed on a terminal, echoing it. Ctrl-C and Ctrl-D
+// end the line as well.
+func readLine(rw io.ReadWriter) (string, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		if _, err := rw.Read(b[:]); err != nil {
+			return string(line), err
+		}
+		switch c := b[0]; {
+		case c == '\r' || c == '\n' || c == 0x03 || c == 0x04:
+			io.WriteString(rw, "\r\n")
+			if c == 0x03 || c == 0x04 {
+				return "", nil
+			}
+			return string(line), nil
+		case c == 0x7f || c == 0x08:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				io.WriteString(rw, "\b \b")
+			}
+		case c >= 0x20 && c < 0x7f:
+			line = append(line, c)
+			rw.Write(b[:])
+		}
+	}
+}
+
+// label returns the name to show for a remote host in the menu.
+func (st *state) label(remote string) string {
+	if h := st.conf.host(remote); h != nil && h.Name != "" {
+		return fmt.Sprintf("%s (%s)", h.Name, remote)
+	}
+	return remote
+}
+
+// menu lets the user pick a remote host, either by moving the highlighted
+// entry with the arrow keys, or by typing its number or part of its name.
+type menu struct {
+	rw      io.ReadWriter
+	remotes []string
+	labels  []string
+	cur     int
+	line    []byte
+
+	// hidden maps what the hidden hosts may be asked for by to their
+	// addresses.
+	hidden map[string]string
+}
+
+const menuPrompt = "Please select remote server: "
+
+func (m *menu) draw() {
+	for i, l := range m.labels {
+		marker := "  "
+		if i == m.cur {
+			marker = "> "
+		}
+		fmt.Fprintf(m.rw, "%s  [%d] %s\r\n", marker, i, l)
+	}
+	fmt.Fprintf(m.rw, "%s%s", menuPrompt, m.line)
+}
+
+// redraw replaces the menu drawn last.
+func (m *menu) redraw() {
+	fmt.Fprintf(m.rw, "\r\x1b[%dA\x1b[J", len(m.labels))
+	m.draw()
+}
+
+func (m *menu) run() (string, error) {
+	m.draw()
+
+	var b [1]byte
+	for {
+		if _, err := m.rw.Read(b[:]); err != nil {
+			return "", err
+		}
+
+		switch c := b[0]; {
+		case c == '\r' || c == '\n':
+			io.WriteString(m.rw, "\r\n")
+			if remote, ok := m.choose(); ok {
+				return remote, nil
+			}
+			m.line = m.line[:0]
+			m.draw()
+		case c == 0x03 || c == 0x04:
+			io.WriteString(m.rw, "\r\n")
+			return "", errSelectionCancelled
+		case c == 0x1b:
+			// Arrow keys are sent as ESC [ A and ESC [ B.
+			var seq [2]byte
+			if _, err := io.ReadFull(m.rw, seq[:]); err != nil {
+				return "", err
+			}
+			if seq[0] != '[' || len(m.labels) == 0 {
+				continue
+			}
+			switch seq[1] {
+			case 'A':
+				m.cur = (m.cur + len(m.labels) - 1) % len(m.labels)
+			case 'B':
+				m.cur = (m.cur + 1) % len(m.labels)
+			default:
+				continue
+			}
+			m.redraw()
+		case c == 0x7f || c == 0x08:
+			if len(m.line) > 0 {
+				m.line = m.line[:len(m.line)-1]
+				io.WriteString(m.rw, "\b \b")
+			}
+		case c >= 0x20 && c < 0x7f:
+			m.line = append(m.line, c)
+			m.rw.Write(b[:])
+		}
+	}
+}
+
+// choose returns the remote host picked by the current input. An empty
+// input picks the highlighted entry. Otherwise, the input is either the
+// number of an entry, or matched against the names of the entries.
+func (m *menu) choose() (string, bool) {
+	input := strings.TrimSpace(string(m.line))
+	if input == "" {
+		if len(m.remotes) == 0 {
+			return "", false
+		}
+		return m.remotes[m.cur], true
+	}
+
+	// Hidden hosts only match exactly, before anything else, so that they
+	// do not show up in the errors below.
+	if remote, ok := m.hidden[input]; ok {
+		return remote, true
+	}
+
+	if n, err := strconv.Atoi(input); err == nil {
+		if n >= 0 && n < len(m.remotes) {
+			return m.remotes[n], true
+		}
+		fmt.Fprintf(m.rw, "Invalid selection\r\n")
+		return "", false
+	}
+
+	matches := matchLabels(m.labels, input)
+	switch len(matches) {
+	case 1:
+		return m.remotes[matches[0]], true
+	case 0:
+		fmt.Fprintf(m.rw, "No host matches %q\r\n", input)
+	default:
+		var names []string
+		for _, i := range matches {
+			names = append(names, m.labels[i])
+		}
+		fmt.Fprintf(m.rw, "%q matches %s\r\n", input, strings.Join(names, ", "))
+	}
+	return "", false
+}
+
+// matchLabels returns the indices of the labels starting with input, or if
+// there are none, of the labels containing it. Case is ignored.
+func matchLabels(labels []string, input string) []int {
+	input = strings.ToLower(input)
+
+	var prefix, substr []int
+	for i, l := range labels {
+		l = strings.ToLower(l)
+		if strings.HasPrefix(l, input) {
+			prefix = append(prefix, i)
+		} else if strings.Contains(l, input) {
+			substr = append(substr, i)
+		}
+	}
+	if len(prefix) > 0 {
+		return prefix
+	}
+	return substr
+}
+
+// motdFor returns the message of the day for a user, preferring the user's
+// own message over the global one.
+func (st *state) motdFor(u *sshmux.User) string {
+	if u != nil {
+		if m, ok := st.conf.UserMotd[u.Name]; ok {
+			return m
+		}
+	}
+	return st.motd
+}
+
+// writeLines writes text to a terminal, translating line endings.
+func writeLines(w io.Writer, text string) {
+	text = strings.TrimRight(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	io.WriteString(w, strings.Replace(text, "\n", "\r\n", -1)+"\r\n")
+}
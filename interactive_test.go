@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joushou/sshmux"
+	"golang.org/x/crypto/ssh"
+)
+
+// parseTestConf parses the given configuration, written to a temporary
+// file.
+func parseTestConf(t *testing.T, conf string) *Conf {
+	filename := filepath.Join(t.TempDir(), "conf.json")
+	if err := ioutil.WriteFile(filename, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseConf(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testSSHConn is the SSH connection of a client.
+type testSSHConn struct {
+	testConn
+}
+
+func (testSSHConn) SendRequest(string, bool, []byte) (bool, []byte, error) { return true, nil, nil }
+func (testSSHConn) OpenChannel(string, []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, io.EOF
+}
+func (testSSHConn) Close() error { return nil }
+func (testSSHConn) Wait() error  { return nil }
+
+// testSession returns a session of the given user, registered with d as
+// sshmux would after authentication.
+func testSession(d *daemon, u *sshmux.User, ip string) *sshmux.Session {
+	c := newPeerConn(ip)
+	tc := &trackedConn{Conn: c, remote: c.RemoteAddr()}
+	tc.touch()
+	d.sessions.add(tc)
+
+	name := "anonymous"
+	if u != nil {
+		name = u.Name
+	}
+	return &sshmux.Session{
+		Conn: &ssh.ServerConn{Conn: testSSHConn{testConn{user: name, remote: tc.RemoteAddr()}}},
+		User: u,
+	}
+}
+
+// terminal is what the user types, and what is shown to them.
+type terminal struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (t *terminal) Read(b []byte) (int, error) { return t.Reader.Read(b) }
+
+func TestConfirmSingleHost(t *testing.T) {
+	c := parseTestConf(t, `{
+		"hosts": [{
+			"address": "db.example.com:22",
+			"users": ["me"],
+			"confirmPrompt": "This is a production database server."
+		}]
+	}`)
+	users := testUsers(t, 1)
+	users[0].user.Name = "me"
+	st, err := newState(c, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+
+	session := testSession(d, users[0].user, "192.0.2.1")
+	if err := d.setup(session); err != nil {
+		t.Fatal(err)
+	}
+	// sshmux picks a single remote without asking interactive.
+	if len(session.Remotes) < 2 {
+		t.Fatalf("remotes are %v, the confirmation prompt would be skipped", session.Remotes)
+	}
+
+	term := &terminal{Reader: strings.NewReader("yes\r")}
+	remote, err := d.interactive(term, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "db.example.com:22" {
+		t.Fatalf("picked %q", remote)
+	}
+	if !strings.Contains(term.String(), "This is a production database server.") {
+		t.Fatalf("prompt not shown, got %q", term.String())
+	}
+	if err := d.selected(session, remote); err != nil {
+		t.Fatalf("confirmed host refused: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseJump splits a jump host of the form "user@host:port".
+func parseJump(s string) (user, address string, err error) {
+	i := strings.LastIndex(s, "@")
+	if i <= 0 {
+		return "", "", fmt.Errorf("jump host %q: missing user", s)
+	}
+	user, address = s[:i], s[i+1:]
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("jump host %q: %v", s, err)
+	}
+	return user, address, nil
+}
+
+// loadIdentities reads the private keys used to log in to jump hosts, keyed
+// by filename.
+func loadIdentities(c *Conf) (map[string]ssh.Signer, error) {
+	signers := make(map[string]ssh.Signer)
+	for _, h := range c.Hosts {
+		if h.JumpIdentityFile == "" || signers[h.JumpIdentityFile] != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(h.JumpIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: jumpIdentityFile: %v", h.Address, err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: jumpIdentityFile: %v", h.Address, err)
+		}
+		signers[h.JumpIdentityFile] = signer
+	}
+	return signers, nil
+}
+
+// jumpDialer returns a function dialing through the jump hosts of h in
+// order, connecting to the first one with dial. The host keys of the jump
+// hosts are verified against the known_hosts file of h.
+func (st *state) jumpDialer(h *Host, dial dialFunc, timeout time.Duration) (dialFunc, error) {
+	cb := st.hostKeys[h.Address]
+	if cb == nil {
+		if !h.InsecureSkipHostKeyCheck {
+			return nil, fmt.Errorf("%s: jump hosts require a known_hosts file", h.Address)
+		}
+		cb = ssh.InsecureIgnoreHostKey()
+	}
+	signer := st.identities[h.JumpIdentityFile]
+
+	return func(network, address string) (net.Conn, error) {
+		var clients []*ssh.Client
+		closeAll := func() {
+			for i := len(clients) - 1; i >= 0; i-- {
+				clients[i].Close()
+			}
+		}
+
+		for _, hop := range h.Jump {
+			user, addr, err := parseJump(hop)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			var conn net.Conn
+			if len(clients) == 0 {
+				conn, err = dial("tcp", addr)
+			} else {
+				conn, err = clients[len(clients)-1].Dial("tcp", addr)
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("jump host %s: %v", addr, err)
+			}
+
+			conn.SetDeadline(time.Now().Add(timeout))
+			c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+				User:            user,
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyCallback: cb,
+				Timeout:         timeout,
+			})
+			if err != nil {
+				conn.Close()
+				closeAll()
+				return nil, fmt.Errorf("jump host %s: %v", addr, err)
+			}
+			conn.SetDeadline(time.Time{})
+			clients = append(clients, ssh.NewClient(c, chans, reqs))
+		}
+
+		conn, err := clients[len(clients)-1].Dial(network, address)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("via jump host %s: %v", h.Jump[len(h.Jump)-1], err)
+		}
+		return &jumpConn{Conn: conn, close: closeAll}, nil
+	}, nil
+}
+
+// jumpConn is a connection tunneled through jump hosts, whose connections
+// are closed along with it.
+type jumpConn struct {
+	net.Conn
+	close func()
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.close()
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/joushou/sshmux"
+)
+
+// defaultKeepaliveMax is how many keepalive requests may go unanswered
+// before a client is disconnected, unless configured otherwise.
+const defaultKeepaliveMax = 3
+
+// keepalive sends a keepalive request to the client every interval, and
+// closes the connection once max requests in a row went unanswered. The
+// requests do not count as activity of conn, so that idle connections are
+// still closed. It returns when the connection is closed.
+func keepalive(session *sshmux.Session, conn *trackedConn, interval time.Duration, max int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	replies := make(chan error, 1)
+	waiting := false
+	missed := 0
+	for range t.C {
+		if waiting {
+			select {
+			case err := <-replies:
+				if err != nil {
+					return
+				}
+				waiting = false
+				missed = 0
+			default:
+				missed++
+				logger.Log("keepalive_missed", sessionFields(session), "%s: keepalive %d of %d unanswered",
+					session.Conn.RemoteAddr(), missed, max)
+				if missed >= max {
+					logger.Log("keepalive", sessionFields(session), "%s: closing connection after %d unanswered keepalives",
+						session.Conn.RemoteAddr(), missed)
+					session.Conn.Close()
+					return
+				}
+				continue
+			}
+		}
+
+		waiting = true
+		go func() {
+			// Clients reply even to requests they do not understand, so any
+			// reply will do.
+			var err error
+			conn.quietly(func() {
+				_, _, err = session.Conn.SendRequest("keepalive@openssh.com", true, nil)
+			})
+			replies <- err
+		}()
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// filterListener wraps a net.Listener, closing the connections for which
+// filter returns false right away. onClose is called once a connection that
+// passed the filter is closed.
+type filterListener struct {
+	net.Listener
+	filter  func(net.Conn) bool
+	onClose func(net.Conn)
+}
+
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter(c) {
+			return &filteredConn{Conn: c, onClose: l.onClose}, nil
+		}
+		c.Close()
+	}
+}
+
+// filteredConn is a connection accepted by a filterListener.
+type filteredConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func(net.Conn)
+}
+
+func (c *filteredConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c.Conn)
+		}
+	})
+	return err
+}
+
+// trackingListener wraps a net.Listener, calling onOpen for every accepted
+// connection and onClose once the connection is closed.
+type trackingListener struct {
+	net.Listener
+	onOpen  func(*trackedConn)
+	onClose func(*trackedConn)
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &trackedConn{Conn: c, remote: c.RemoteAddr(), onClose: l.onClose}
+	if _, ok := tc.remote.(*net.UnixAddr); ok || tc.remote == nil {
+		// Peers on Unix sockets are usually unnamed. Give each one its own
+		// address value, so that it can be told apart from the others.
+		tc.remote = &net.UnixAddr{Name: "@", Net: "unix"}
+	}
+	tc.touch()
+	if l.onOpen != nil {
+		l.onOpen(tc)
+	}
+	return tc, nil
+}
+
+// trackedConn is a connection accepted by a trackingListener. It records the
+// time data was last read or written, and how much data was transferred.
+//
+// The value returned by RemoteAddr is unique to the connection, and is used
+// to find the connection from the sshmux callbacks.
+type trackedConn struct {
+	net.Conn
+	remote     net.Addr
+	lastActive int64
+	bytesIn    int64 // from the client, accessed atomically
+	bytesOut   int64 // to the client, accessed atomically
+	once       sync.Once
+	onClose    func(*trackedConn)
+
+	// quietWrite and quietRead mark the next write, and the read after
+	// it, as a keepalive request and its reply, which are not activity.
+	// Accessed atomically.
+	quietWrite int32
+	quietRead  int32
+
+	// idleMu guards the idle timeout, which may change once the user of
+	// the connection is known.
+	idleMu      sync.Mutex
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	onIdle      func(time.Duration)
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *trackedConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// quietly runs f, which writes a single request on the connection and waits
+// for the reply, such as a keepalive, without the request and the reply
+// counting as activity. The next write is taken to be the request, and the
+// next read after it the reply. A read or write racing them may be taken for
+// them instead, in which case the request or reply counts in its place.
+func (c *trackedConn) quietly(f func()) {
+	atomic.StoreInt32(&c.quietWrite, 1)
+	f()
+	atomic.StoreInt32(&c.quietWrite, 0)
+	atomic.StoreInt32(&c.quietRead, 0)
+}
+
+// idle returns how long it has been since data was last read or written.
+func (c *trackedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if !atomic.CompareAndSwapInt32(&c.quietRead, 1, 0) {
+			c.touch()
+		}
+		atomic.AddInt64(&c.bytesIn, int64(n))
+		bytesReceived.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		if atomic.CompareAndSwapInt32(&c.quietWrite, 1, 0) {
+			atomic.StoreInt32(&c.quietRead, 1)
+		} else {
+			c.touch()
+		}
+		atomic.AddInt64(&c.bytesOut, int64(n))
+		bytesSent.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+	return err
+}
+
+// closeWhenIdle closes the connection once no data has been read or written
+// for the given duration, calling onIdle with it first. It may be called
+// again to change the timeout; a timeout of zero or less disables it.
+func (c *trackedConn) closeWhenIdle(timeout time.Duration, onIdle func(time.Duration)) {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+
+	c.idleTimeout = timeout
+	c.onIdle = onIdle
+	switch {
+	case c.idleTimer != nil:
+		// Check against the new timeout right away.
+		c.idleTimer.Reset(0)
+	case timeout > 0:
+		c.idleTimer = time.AfterFunc(timeout, c.checkIdle)
+	}
+}
+
+func (c *trackedConn) checkIdle() {
+	c.idleMu.Lock()
+	timeout, onIdle := c.idleTimeout, c.onIdle
+	if timeout <= 0 {
+		c.idleMu.Unlock()
+		return
+	}
+	if left := timeout - c.idle(); left > 0 {
+		c.idleTimer.Reset(left)
+		c.idleMu.Unlock()
+		return
+	}
+	c.idleMu.Unlock()
+
+	onIdle(timeout)
+	c.Close()
+}
+
+// connCounter counts open connections, and allows waiting for them to close.
+type connCounter struct {
+	wg sync.WaitGroup
+	n  int64
+}
+
+func (c *connCounter) open() {
+	c.wg.Add(1)
+	atomic.AddInt64(&c.n, 1)
+	activeSessions.Inc()
+}
+
+func (c *connCounter) close() {
+	activeSessions.Dec()
+	atomic.AddInt64(&c.n, -1)
+	c.wg.Done()
+}
+
+func (c *connCounter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// wait waits for all connections to be closed. It gives up when the timeout
+// elapses or a signal is received on abort, returning false.
+func (c *connCounter) wait(timeout time.Duration, abort <-chan os.Signal) bool {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+	case <-abort:
+	}
+	return false
+}
+
+// tunedListener applies the TCP options of the configuration to the
+// connections it accepts.
+type tunedListener struct {
+	net.Listener
+	noDelay   bool
+	keepalive time.Duration
+}
+
+// tuneListener wraps l if tcpNoDelay or tcpKeepalive is set. Otherwise the
+// defaults of Go apply: no delay, and keepalives every 15 seconds.
+func tuneListener(l net.Listener, c *Conf) net.Listener {
+	if c.TCPNoDelay == nil && c.TCPKeepalive == 0 {
+		return l
+	}
+	tl := &tunedListener{Listener: l, noDelay: true, keepalive: time.Duration(c.TCPKeepalive)}
+	if c.TCPNoDelay != nil {
+		tl.noDelay = *c.TCPNoDelay
+	}
+	return tl
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(l.noDelay)
+		switch {
+		case l.keepalive > 0:
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.keepalive)
+		case l.keepalive < 0:
+			tc.SetKeepAlive(false)
+		}
+	}
+	return c, nil
+}
+
+// listen opens a listener on address. Addresses of the form "unix:path" are
+// Unix domain sockets, everything else is a TCP address. A stale socket file
+// is removed first, and the permissions of the new one are set to mode, if
+// given.
+func listen(address, mode string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid socketMode %q", mode)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testListener hands out the connections sent on its channel.
+type testListener struct {
+	conns chan net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+	return c, nil
+}
+
+func (l *testListener) Close() error   { close(l.conns); return nil }
+func (l *testListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22} }
+
+// peerConn is one end of a pipe, from the given remote address. closed is
+// closed once the connection is.
+type peerConn struct {
+	net.Conn
+	remote net.Addr
+	closed chan struct{}
+}
+
+func newPeerConn(ip string) *peerConn {
+	c, other := net.Pipe()
+	other.Close()
+	return &peerConn{Conn: c, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}, closed: make(chan struct{})}
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *peerConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.Conn.Close()
+}
+
+func TestBannedPeerHoldsNoSlot(t *testing.T) {
+	st, err := newState(&Conf{
+		MaxConnections:         1,
+		ConnectionQueue:        10,
+		ConnectionQueueTimeout: duration(time.Hour),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(nil, st)
+	d.bans.fail("192.0.2.1", 1, time.Minute, time.Hour)
+
+	tl := &testListener{conns: make(chan net.Conn)}
+	l := d.track(d.limit(d.filter(tl)))
+	defer tl.Close()
+
+	for i := 0; i < 3; i++ {
+		c := newPeerConn("192.0.2.1")
+		tl.conns <- c
+		select {
+		case <-c.closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection of a banned address was not closed")
+		}
+	}
+
+	// With a banned connection holding the only slot, this one would wait
+	// in the queue.
+	tl.conns <- newPeerConn("192.0.2.2")
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	var c net.Conn
+	select {
+	case c = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not accepted")
+	}
+
+	d.slots.mu.Lock()
+	open := d.slots.open
+	d.slots.mu.Unlock()
+	if open != 1 {
+		t.Fatalf("%d slots taken, want 1", open)
+	}
+
+	c.Close()
+	d.slots.mu.Lock()
+	open = d.slots.open
+	d.slots.mu.Unlock()
+	if open != 0 {
+		t.Fatalf("%d slots taken after closing, want 0", open)
+	}
+}
+
+// echoConn answers every write with a reply of the same size, after delay.
+type echoConn struct {
+	net.Conn
+	replies chan []byte
+	delay   time.Duration
+}
+
+func (c *echoConn) Write(b []byte) (int, error) {
+	go func(b []byte) {
+		time.Sleep(c.delay)
+		c.replies <- b
+	}(append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *echoConn) Read(b []byte) (int, error) {
+	return copy(b, <-c.replies), nil
+}
+
+func TestQuietlyLeavesOtherActivity(t *testing.T) {
+	ec := &echoConn{replies: make(chan []byte, 10), delay: 10 * time.Millisecond}
+	tc := &trackedConn{Conn: ec}
+	tc.touch()
+	atomic.StoreInt64(&tc.lastActive, time.Now().Add(-time.Hour).UnixNano())
+
+	// A keepalive and its reply are not activity.
+	tc.quietly(func() {
+		tc.Write([]byte("k"))
+		tc.Read(make([]byte, 1))
+	})
+	if idle := tc.idle(); idle < time.Hour {
+		t.Fatalf("idle for %v after a keepalive, want an hour", idle)
+	}
+
+	// Data read while the keepalive is answered still counts, even if it
+	// is taken for the reply.
+	done := make(chan struct{})
+	go func() {
+		tc.quietly(func() {
+			tc.Write([]byte("k"))
+			tc.Read(make([]byte, 1))
+		})
+		close(done)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	ec.replies <- []byte("x")
+	<-done
+	tc.Read(make([]byte, 1))
+	if idle := tc.idle(); idle > time.Minute {
+		t.Fatalf("idle for %v after reading data during a keepalive", idle)
+	}
+}
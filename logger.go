@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fields holds the structured data of a log record, such as "remote_addr",
+// "username", "ssh_user" and "target".
+type fields map[string]interface{}
+
+// logLevel is the severity of a log record. Only records at or above the
+// configured level are written.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (lv logLevel) String() string {
+	return levelNames[lv]
+}
+
+func parseLevel(s string) (logLevel, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// eventLevels holds the level of the events not logged at info.
+var eventLevels = map[string]logLevel{
+	"selection_denied": levelWarn,
+	"auth_denied":      levelWarn,
+	"auth_revoked":     levelWarn,
+	"auth_throttled":   levelWarn,
+	"authkeys":         levelWarn,
+	"ban":              levelWarn,
+	"cert_rejected":    levelWarn,
+	"config":           levelWarn,
+	"confirm_denied":   levelWarn,
+	"connection_limit": levelWarn,
+	"dial_failed":      levelWarn,
+	"dial_retry":       levelWarn,
+	"geoip_blocked":    levelWarn,
+	"hosts_url":        levelWarn,
+	"keepalive":        levelWarn,
+	"no_remotes":       levelWarn,
+	"panic":            levelError,
+	"proxy_protocol":   levelWarn,
+	"session_dump":     levelError,
+	"session_limit":    levelWarn,
+	"webhook":          levelWarn,
+
+	"authkeys_option":  levelDebug,
+	"connect":          levelDebug,
+	"draining":         levelDebug,
+	"keepalive_missed": levelDebug,
+}
+
+// eventLogger writes log records either as the usual free-text lines, or as
+// one JSON object per line.
+type eventLogger struct {
+	mu      sync.Mutex
+	asJSON  bool
+	level   logLevel
+	jsonOut *log.Logger
+
+	// timeFormat is the layout of the timestamps, if configured, and utc
+	// makes them use UTC rather than local time.
+	timeFormat string
+	utc        bool
+
+	// path is the log file, if the log is written to one.
+	path string
+	file *os.File
+}
+
+var logger = &eventLogger{
+	level:   levelInfo,
+	jsonOut: log.New(os.Stderr, "", 0),
+}
+
+// setFormat selects the output format, either "text" (the default) or
+// "json".
+func (l *eventLogger) setFormat(format string) error {
+	var asJSON bool
+	switch format {
+	case "", "text":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	l.mu.Lock()
+	l.asJSON = asJSON
+	l.mu.Unlock()
+	return nil
+}
+
+// timeFormats are the names that may be given instead of a layout for the
+// timestamps.
+var timeFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+// setTime configures the timestamps of the records: format is a name from
+// timeFormats or a layout as understood by time.Format, and utc selects UTC
+// over local time. If format is empty, text records keep the timestamps of
+// the log package, and JSON records use RFC 3339 with nanoseconds.
+func (l *eventLogger) setTime(format string, utc bool) {
+	if f, ok := timeFormats[strings.ToLower(format)]; ok {
+		format = f
+	}
+
+	l.mu.Lock()
+	l.timeFormat = format
+	l.utc = utc
+	l.mu.Unlock()
+
+	switch {
+	case format != "":
+		// The timestamp is added by write.
+		log.SetFlags(0)
+	case utc:
+		log.SetFlags(log.Flags() | log.LUTC)
+	}
+}
+
+// timestamp formats t for a record.
+func (l *eventLogger) timestamp(t time.Time) string {
+	l.mu.Lock()
+	format, utc := l.timeFormat, l.utc
+	l.mu.Unlock()
+
+	if utc {
+		t = t.UTC()
+	}
+	if format == "" {
+		format = time.RFC3339Nano
+	}
+	return t.Format(format)
+}
+
+// setLevel sets the level of the records to write.
+func (l *eventLogger) setLevel(lv logLevel) {
+	l.mu.Lock()
+	l.level = lv
+	l.mu.Unlock()
+}
+
+// cycleLevel switches to the next more verbose level, going back to the
+// least verbose after debug, and returns the new level.
+func (l *eventLogger) cycleLevel() logLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = (l.level + 1) % logLevel(len(levelNames))
+	return l.level
+}
+
+// errNoSyslog is returned by openSyslog on platforms without syslog.
+var errNoSyslog = errors.New("syslog is not supported on this platform")
+
+// setTarget selects where records are written: "stderr" (the default),
+// "syslog", or "file", which appends to the file at path. If syslog is not
+// available, records keep going to stderr.
+func (l *eventLogger) setTarget(target, path, facility, tag string) error {
+	switch target {
+	case "", "stderr":
+		return nil
+	case "file":
+		if path == "" {
+			return errors.New("the file log target requires logFile")
+		}
+		l.mu.Lock()
+		l.path = path
+		l.mu.Unlock()
+		return l.reopen()
+	case "syslog":
+	default:
+		return fmt.Errorf("unknown log target %q", target)
+	}
+
+	w, err := openSyslog(facility, tag)
+	if err == errNoSyslog {
+		l.Log("config", fields{"error": err.Error()}, "ignoring logTarget syslog, logging to stderr: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The system logger adds its own timestamps.
+	log.SetFlags(0)
+	l.setOutput(w)
+	return nil
+}
+
+// reopen opens the log file again, so that it can be rotated. It does
+// nothing unless the log is written to a file.
+func (l *eventLogger) reopen() error {
+	l.mu.Lock()
+	path := l.path
+	l.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.setOutput(f)
+
+	l.mu.Lock()
+	old := l.file
+	l.file = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *eventLogger) setOutput(w io.Writer) {
+	log.SetOutput(w)
+	l.jsonOut.SetOutput(w)
+}
+
+// Log writes a record for the named event, at the level given in
+// eventLevels. The message is formatted as with log.Printf, and is all that
+// is written in text format.
+func (l *eventLogger) Log(event string, f fields, format string, args ...interface{}) {
+	if auditEvents[event] {
+		audit.record(event, f)
+	}
+
+	lv, ok := eventLevels[event]
+	if !ok {
+		lv = levelInfo
+	}
+	l.write(lv, event, f, format, args...)
+}
+
+func (l *eventLogger) write(lv logLevel, event string, f fields, format string, args ...interface{}) {
+	l.mu.Lock()
+	asJSON, max := l.asJSON, l.level
+	l.mu.Unlock()
+
+	if lv > max {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	if !asJSON {
+		if l.customTime() {
+			msg = l.timestamp(time.Now()) + " " + msg
+		}
+		log.Print(msg)
+		return
+	}
+
+	rec := make(map[string]interface{}, len(f)+4)
+	for k, v := range f {
+		rec[k] = v
+	}
+	rec["time"] = l.timestamp(time.Now())
+	rec["level"] = lv.String()
+	rec["event"] = event
+	rec["msg"] = msg
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("could not encode log record: %v (%s)", err, msg)
+		return
+	}
+	l.jsonOut.Print(string(b))
+}
+
+// customTime reports whether a time format is configured.
+func (l *eventLogger) customTime() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.timeFormat != ""
+}
+
+// Fatal writes a record like Log, at error level, and exits.
+func (l *eventLogger) Fatal(event string, f fields, format string, args ...interface{}) {
+	l.write(levelError, event, f, format, args...)
+	os.Exit(1)
+}
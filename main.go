@@ -1,188 +1,484 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joushou/sshmux"
 
 	"golang.org/x/crypto/ssh"
 )
 
-func usage() {
-	fmt.Printf("Usage: \n")
-	fmt.Printf("   %s conf\n", os.Args[0])
+// defaultShutdownTimeout is how long open sessions are waited for on
+// shutdown, unless configured otherwise.
+const defaultShutdownTimeout = 30 * time.Second
+
+// fileList is a flag that may be given more than once.
+type fileList []string
+
+func (l *fileList) String() string { return strings.Join(*l, ",") }
+
+func (l *fileList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
-type Host struct {
-	Address string   `json:"address"`
-	Users   []string `json:"users"`
-	NoAuth  bool     `json:"noAuth"`
+var confFlags fileList
+
+func init() {
+	flag.Var(&confFlags, "config", "a configuration `file`, may be given more than once to merge several")
 }
 
-type Conf struct {
-	Address  string `json:"address"`
-	HostKey  string `json:"hostkey"`
-	AuthKeys string `json:"authkeys"`
-	Hosts    []Host `json:"hosts"`
+var (
+	checkOnly   = flag.Bool("check", false, "check the configuration and exit")
+	printOnly   = flag.Bool("print-config", false, "print the configuration as loaded and exit")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+	levelFlag   = flag.String("log-level", "", "the `level` to log at, overriding logLevel of the configuration")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: \n")
+	fmt.Fprintf(os.Stderr, "   %s [flags] -config conf [-config conf...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "   %s [flags] conf [conf...]\n\n", os.Args[0])
+	flag.PrintDefaults()
 }
 
-func parseConf(filename string) (*Conf, error) {
-	f, err := ioutil.ReadFile(filename)
+// state holds the parts of the configuration that can be swapped at runtime.
+type state struct {
+	conf        *Conf
+	users       []*authEntry
+	keys        map[string]*authEntry
+	hostKeys    map[string]ssh.HostKeyCallback
+	identities  map[string]ssh.Signer
+	next        map[string]*uint32
+	targets     map[string]string
+	cas         map[string]bool
+	denied      map[string]bool
+	motd        string
+	hasDefaults bool
+}
+
+func loadState(filenames []string) (*state, error) {
+	c, err := parseConf(filenames...)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Conf{}
-	err = json.Unmarshal(f, c)
+	// The authkeys of all configuration files are combined.
+	authKeys := c.authKeysFiles
+	if len(authKeys) == 0 {
+		authKeys = []string{c.AuthKeys}
+	}
+	var users []*authEntry
+	for _, filename := range authKeys {
+		u, err := parseAuthFile(filename, c.AuthKeysToken, c.StrictAuthKeys)
+		if err != nil {
+			return nil, fmt.Errorf("authkeys: %v", err)
+		}
+		users = append(users, u...)
+	}
+
+	st, err := newState(c, users)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	if c.TrustedCAs != "" {
+		cas, err := parseAuthFile(c.TrustedCAs, c.AuthKeysToken, c.StrictAuthKeys)
+		if err != nil {
+			return nil, fmt.Errorf("trustedCAs: %v", err)
+		}
+		st.cas = make(map[string]bool, len(cas))
+		for _, ca := range cas {
+			st.cas[keyID(ca.user.PublicKey)] = true
+		}
+	}
+
+	if c.DenyKeys != "" {
+		denied, err := parseAuthFile(c.DenyKeys, c.AuthKeysToken, c.StrictAuthKeys)
+		if err != nil {
+			return nil, fmt.Errorf("denyKeys: %v", err)
+		}
+		st.denied = make(map[string]bool, len(denied))
+		for _, e := range denied {
+			st.denied[keyID(e.user.PublicKey)] = true
+		}
+	}
+
+	if err := geo.load(c.GeoIPDB, c.GeoIPASNDB); err != nil {
+		return nil, err
+	}
+
+	return st, nil
 }
 
-func parseAuthFile(filename string) ([]*sshmux.User, error) {
-	var users []*sshmux.User
+// newState prepares the state for a parsed configuration and its users.
+func newState(c *Conf, users []*authEntry) (*state, error) {
+	// The first entry wins if a key is listed more than once.
+	keys := make(map[string]*authEntry, len(users))
+	for _, e := range users {
+		id := keyID(e.user.PublicKey)
+		if _, ok := keys[id]; !ok {
+			keys[id] = e
+		}
+	}
 
-	authFile, err := ioutil.ReadFile(filename)
+	hostKeys, err := loadKnownHosts(c)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse authfile as authorized_key
+	identities, err := loadIdentities(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round-robin position of each host with several backends.
+	next := make(map[string]*uint32)
+	for _, h := range c.Hosts {
+		if len(h.Addresses) > 0 {
+			next[h.Address] = new(uint32)
+		}
+	}
 
-	for len(authFile) > 0 {
-		var (
-			pk      ssh.PublicKey
-			comment string
-		)
+	// Names and aliases of the hosts, mapped to their addresses.
+	targets := make(map[string]string)
+	for _, h := range c.Hosts {
+		if h.tmpl != nil {
+			continue
+		}
+		for _, t := range h.targets() {
+			if other, ok := targets[t]; ok && other != h.Address {
+				return nil, fmt.Errorf("host %s: %s is already used by host %s", h.Address, t, other)
+			}
+			targets[t] = h.Address
+		}
+	}
 
-		pk, comment, _, authFile, err = ssh.ParseAuthorizedKey(authFile)
-		if err != nil {
-			return nil, err
+	hasDefaults := false
+	for _, h := range c.Hosts {
+		if h.NoAuth {
+			hasDefaults = true
+			break
 		}
+	}
 
-		u := &sshmux.User{
-			PublicKey: pk,
-			Name:      comment,
+	motd := c.Motd
+	if c.MotdFile != "" {
+		b, err := ioutil.ReadFile(c.MotdFile)
+		if err != nil {
+			return nil, fmt.Errorf("motdFile: %v", err)
 		}
+		motd = string(b)
+	}
+
+	return &state{
+		conf:        c,
+		users:       users,
+		keys:        keys,
+		hostKeys:    hostKeys,
+		identities:  identities,
+		next:        next,
+		targets:     targets,
+		motd:        motd,
+		hasDefaults: hasDefaults,
+	}, nil
+}
 
-		users = append(users, u)
+// canonical returns the address of the host with the given address, name or
+// alias. Unknown targets are returned as they are.
+func (st *state) canonical(target string) string {
+	if a, ok := st.targets[target]; ok {
+		return a
 	}
+	return target
+}
 
-	return users, nil
+// sessionFields returns the log fields describing a session.
+func sessionFields(session *sshmux.Session) fields {
+	f := fields{
+		"remote_addr": session.Conn.RemoteAddr().String(),
+		"ssh_user":    session.Conn.User(),
+	}
+	if name := clientNames.get(remoteIP(session.Conn.RemoteAddr())); name != "" {
+		f["remote_host"] = name
+	}
+	geo.addFields(remoteIP(session.Conn.RemoteAddr()), f)
+	if session.User != nil {
+		f["username"] = session.User.Name
+		f["fingerprint"] = ssh.FingerprintSHA256(session.User.PublicKey)
+	} else {
+		f["anonymous"] = true
+	}
+	return f
 }
 
 func main() {
 	// Config
-	if len(os.Args) != 2 {
-		usage()
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
 		return
 	}
 
-	conf := os.Args[1]
+	// The configuration files may also be given as arguments. Later files
+	// are merged over earlier ones.
+	conf := append([]string(confFlags), flag.Args()...)
+	if len(conf) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if _, err := parseLevel(*levelFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "-log-level: %v\n", err)
+		os.Exit(2)
+	}
 
-	c, err := parseConf(conf)
-	if err != nil {
-		panic(err)
+	if *printOnly {
+		if err := printConfig(conf); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
 	}
 
-	hostPrivateKey, err := ioutil.ReadFile(c.HostKey)
-	if err != nil {
-		panic(err)
+	if *checkOnly {
+		if !checkConfig(conf) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	hostSigner, err := ssh.ParsePrivateKey(hostPrivateKey)
+	st, err := loadState(conf)
 	if err != nil {
-		panic(err)
+		log.Fatalf("%v", err)
 	}
 
-	users, err := parseAuthFile(c.AuthKeys)
+	// The log format, timestamps, level and target are only applied at
+	// startup, so a level given with -log-level stays in effect across
+	// reloads.
+	if err := logger.setFormat(st.conf.LogFormat); err != nil {
+		log.Fatalf("%v", err)
+	}
+	logger.setTime(st.conf.LogTimeFormat, st.conf.LogUTC)
+	level := st.conf.LogLevel
+	if *levelFlag != "" {
+		level = *levelFlag
+	}
+	lv, err := parseLevel(level)
 	if err != nil {
-		panic(err)
+		log.Fatalf("%v", err)
+	}
+	logger.setLevel(lv)
+	if err := logger.setTarget(st.conf.LogTarget, st.conf.LogFile, st.conf.SyslogFacility, st.conf.SyslogTag); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	hasDefaults := false
-	for _, h := range c.Hosts {
-		if h.NoAuth {
-			hasDefaults = true
-			break
+	logger.Log("startup", fields{"version": version, "commit": commit, "build_date": buildDate}, "starting %s", versionString())
+
+	if err := audit.open(st.conf.AuditLog); err != nil {
+		log.Fatalf("auditLog: %v", err)
+	}
+
+	d := newDaemon(conf, st)
+
+	// Reload hosts and users, and reopen the log files, on SIGHUP. The host
+	// key and listening addresses are only read at startup.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := d.reload(conf)
+			if err != nil {
+				logger.Log("reload", fields{"error": err.Error()}, "reload failed, keeping old configuration: %v", err)
+			} else {
+				logger.Log("reload", nil, "configuration reloaded")
+			}
+
+			// Reopen the log files, so that they can be rotated.
+			if err := logger.reopen(); err != nil {
+				logger.Log("reload", fields{"error": err.Error()}, "could not reopen log file: %v", err)
+			}
+			if err := audit.open(d.state().conf.AuditLog); err != nil {
+				logger.Log("reload", fields{"error": err.Error()}, "could not reopen audit log: %v", err)
+			}
+		}
+	}()
+
+	// Dump the status, the ban list and the open sessions on SIGUSR1.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			d.logStatus()
+			d.logBans()
+			if err := d.dumpSessions(); err != nil {
+				logger.Log("session_dump", fields{"error": err.Error()}, "could not dump sessions: %v", err)
+			}
+		}
+	}()
+
+	// Start draining on SIGTTIN, and stop on SIGTTOU.
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGTTIN, syscall.SIGTTOU)
+	go func() {
+		for sig := range drain {
+			d.setDraining(sig == syscall.SIGTTIN, sig.String())
 		}
+	}()
+
+	// Switch to the next log level on SIGUSR2.
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			lv := logger.cycleLevel()
+			logger.write(levelError, "log_level", fields{"level": lv.String()}, "log level set to %s", lv)
+		}
+	}()
+
+	go d.housekeeping()
+	go d.pollHosts()
+	go d.health.run(d)
+	go d.webhook.run(d)
+
+	stopHeartbeat := make(chan struct{})
+	go d.heartbeat(stopHeartbeat)
+
+	c := st.conf
+
+	hostSigner, err := loadHostKey(c)
+	if err != nil {
+		logger.Fatal("startup", fields{"error": err.Error()}, "hostkey: %v", err)
 	}
 
 	// sshmux setup
-	auth := func(c ssh.ConnMetadata, key ssh.PublicKey) (*sshmux.User, error) {
-		t := key.Type()
-		k := key.Marshal()
-		for i := range users {
-			candidate := users[i].PublicKey
-			if t == candidate.Type() && bytes.Compare(k, candidate.Marshal()) == 0 {
-				return users[i], nil
+	server := sshmux.New(hostSigner, d.safeAuth, d.safeSetup)
+	server.Selected = d.safeSelected
+	server.Interactive = d.safeInteractive
+	server.Dialer = d.safeDial
+
+	// Set up listeners. All of them are bound before dropping privileges,
+	// so that privileged ports can be used, but only served afterwards.
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	listeners, err = activationListeners()
+	if err != nil {
+		logger.Fatal("startup", fields{"error": err.Error()}, "%v", err)
+	}
+	if listeners != nil {
+		logger.Log("startup", fields{"count": len(listeners)}, "using %d sockets passed by systemd", len(listeners))
+	} else {
+		for _, addr := range c.listenAddresses() {
+			l, err := listen(addr, c.SocketMode)
+			if err != nil {
+				closeAll()
+				logger.Fatal("startup", fields{"address": addr, "error": err.Error()}, "listen on %s: %v", addr, err)
 			}
+			listeners = append(listeners, l)
 		}
+	}
+	if len(listeners) == 0 {
+		logger.Fatal("startup", nil, "no listening address configured")
+	}
 
-		if hasDefaults {
-			return nil, nil
+	var metricsListener, adminListener net.Listener
+	if c.Metrics != "" {
+		if metricsListener, err = net.Listen("tcp", c.Metrics); err != nil {
+			closeAll()
+			logger.Fatal("startup", fields{"address": c.Metrics, "error": err.Error()}, "metrics: listen on %s: %v", c.Metrics, err)
+		}
+	}
+	if c.AdminAddress != "" {
+		if adminListener, err = net.Listen("tcp", c.AdminAddress); err != nil {
+			if metricsListener != nil {
+				metricsListener.Close()
+			}
+			closeAll()
+			logger.Fatal("startup", fields{"address": c.AdminAddress, "error": err.Error()}, "adminAddress: listen on %s: %v", c.AdminAddress, err)
 		}
-
-		log.Printf("%s: access denied (username: %s)", c.RemoteAddr(), c.User())
-		return nil, errors.New("access denied")
 	}
 
-	setup := func(session *sshmux.Session) error {
-		var username string
-		if session.User != nil {
-			username = session.User.Name
-		} else {
-			username = "unknown user"
+	if c.PIDFile != "" {
+		if err := writePIDFile(c.PIDFile); err != nil {
+			closeAll()
+			logger.Fatal("startup", fields{"error": err.Error()}, "pidFile: %v", err)
+		}
+		defer os.Remove(c.PIDFile)
+	}
+	if c.User != "" || c.Group != "" {
+		if err := dropPrivileges(c.User, c.Group); err != nil {
+			closeAll()
+			logger.Fatal("startup", fields{"error": err.Error()}, "could not drop privileges: %v", err)
 		}
-		log.Printf("%s: %s authorized (username: %s)", session.Conn.RemoteAddr(), username, session.Conn.User())
+		logger.Log("startup", fields{"user": c.User, "group": c.Group}, "running as user %q, group %q", c.User, c.Group)
+	}
 
-	outer:
-		for _, h := range c.Hosts {
-			if h.NoAuth {
-				session.Remotes = append(session.Remotes, h.Address)
-				continue outer
-			}
+	if metricsListener != nil {
+		go serveMetrics(metricsListener)
+	}
+	if adminListener != nil {
+		go d.serveAdmin(adminListener)
+	}
 
-			if session.User == nil {
-				continue
+	serveErrs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			l = tuneListener(l, c)
+			if c.ProxyProtocol {
+				l = newProxyListener(l)
 			}
+			serveErrs <- server.Serve(d.track(d.limit(d.filter(l))))
+		}(l)
+	}
 
-			for _, u := range h.Users {
-				if u == session.User.Name {
-					session.Remotes = append(session.Remotes, h.Address)
-					continue outer
-				}
-			}
+	// removePIDFile is for the exits that skip the deferred removal.
+	removePIDFile := func() {
+		if c.PIDFile != "" {
+			os.Remove(c.PIDFile)
 		}
-		return nil
 	}
 
-	server := sshmux.New(hostSigner, auth, setup)
-	server.Selected = func(session *sshmux.Session, remote string) error {
-		var username string
-		if session.User != nil {
-			username = session.User.Name
-		} else {
-			username = "unknown user"
-		}
-		log.Printf("%s: %s connecting to %s", session.Conn.RemoteAddr(), username, remote)
-		return nil
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Log("startup", fields{"error": err.Error()}, "could not notify systemd: %v", err)
 	}
 
-	// Set up listener
-	l, err := net.Listen("tcp", c.Address)
-	if err != nil {
-		panic(err)
+	// Stop accepting connections on SIGTERM or SIGINT, and give the open
+	// sessions some time to finish. A second signal exits immediately.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case sig := <-stop:
+		logger.Log("shutdown", fields{"signal": sig.String()}, "received %v, shutting down", sig)
+		closeAll()
+		close(stopHeartbeat)
+	case err := <-serveErrs:
+		closeAll()
+		removePIDFile()
+		logger.Fatal("shutdown", fields{"error": err.Error()}, "listener failed: %v", err)
 	}
 
-	server.Serve(l)
+	timeout := time.Duration(c.ShutdownTimeout)
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	if !d.conns.wait(timeout, stop) {
+		n := d.conns.count()
+		logger.Log("shutdown", fields{"active_sessions": n}, "exiting with %d sessions still active", n)
+		removePIDFile()
+		os.Exit(1)
+	}
+	logger.Log("shutdown", nil, "all sessions closed, exiting")
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sshmuxd_build_info",
+		Help: "Always 1, labeled with the version of sshmuxd.",
+	}, []string{"version", "commit", "build_date"})
+
+	activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sshmuxd_active_sessions",
+		Help: "Number of currently open client connections.",
+	})
+
+	queuedConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sshmuxd_queued_connections",
+		Help: "Number of client connections waiting for the connection limit.",
+	})
+
+	authentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshmuxd_authentications_total",
+		Help: "Number of authentication attempts, by result.",
+	}, []string{"result"})
+
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshmuxd_transferred_bytes_total",
+		Help: "Number of bytes received from (in) and sent to (out) clients.",
+	}, []string{"direction"})
+
+	remoteConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshmuxd_remote_connections_total",
+		Help: "Number of connections made to each remote host.",
+	}, []string{"remote"})
+
+	sessionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sshmuxd_session_duration_seconds",
+		Help:    "Duration of closed sessions, by remote host and user.",
+		Buckets: []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+	}, []string{"remote", "username"})
+
+	sessionBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sshmuxd_session_bytes",
+		Help:    "Bytes received from (in) and sent to (out) the client in closed sessions, by remote host and user.",
+		Buckets: prometheus.ExponentialBuckets(1024, 8, 9),
+	}, []string{"remote", "username", "direction"})
+)
+
+// The transferred bytes are counted for every read and write, so the
+// counters are looked up once.
+var (
+	bytesReceived = transferredBytes.WithLabelValues("in")
+	bytesSent     = transferredBytes.WithLabelValues("out")
+)
+
+func init() {
+	buildInfo.WithLabelValues(version, commit, buildDate).Set(1)
+	prometheus.MustRegister(buildInfo, activeSessions, queuedConnections, authentications, transferredBytes, remoteConnections,
+		sessionDuration, sessionBytes)
+}
+
+// observeSession records a closed session in the histograms. The username
+// label is left empty unless metricsUsernames is set, to keep the number of
+// series down. Sessions that never selected a remote host have the remote
+// "none".
+func observeSession(c *Conf, s *sessionInfo, in, out int64, d time.Duration) {
+	s.mu.Lock()
+	remote, username := s.target, s.username
+	s.mu.Unlock()
+
+	if remote == "" {
+		remote = "none"
+	}
+	if !c.MetricsUsernames {
+		username = ""
+	}
+	sessionDuration.WithLabelValues(remote, username).Observe(d.Seconds())
+	sessionBytes.WithLabelValues(remote, username, "in").Observe(float64(in))
+	sessionBytes.WithLabelValues(remote, username, "out").Observe(float64(out))
+}
+
+// serveMetrics exposes the Prometheus metrics over HTTP on l. It does not
+// return.
+func serveMetrics(l net.Listener) {
+	addr := l.Addr().String()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger.Log("metrics", fields{"address": addr}, "serving metrics on %s", addr)
+	err := http.Serve(l, mux)
+	logger.Log("metrics", fields{"address": addr, "error": err.Error()}, "metrics server failed: %v", err)
+}
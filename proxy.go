@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc dials a network address, like net.Dial.
+type dialFunc func(network, address string) (net.Conn, error)
+
+// parseProxy checks a proxy URL of a host.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// redactProxies returns a copy of hosts with the passwords in their proxy
+// URLs hidden, for showing the hosts.
+func redactProxies(hosts []Host) []Host {
+	res := make([]Host, len(hosts))
+	copy(res, hosts)
+	for i := range res {
+		if res[i].Proxy == "" {
+			continue
+		}
+		if u, err := url.Parse(res[i].Proxy); err == nil {
+			res[i].Proxy = u.Redacted()
+		} else {
+			res[i].Proxy = "(hidden)"
+		}
+	}
+	return res
+}
+
+// proxyDialer returns a function dialing through the proxy at proxyURL,
+// which connects to the proxy with forward. SOCKS5 proxies and HTTP proxies
+// supporting CONNECT are understood. Credentials for the proxy are taken
+// from the URL.
+func proxyDialer(proxyURL string, forward *net.Dialer, timeout time.Duration) (dialFunc, error) {
+	u, err := parseProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return func(network, address string) (net.Conn, error) {
+			conn, err := dialConnect(u, forward, timeout, address)
+			if err != nil {
+				return nil, fmt.Errorf("via proxy %s: %v", u.Redacted(), err)
+			}
+			return conn, nil
+		}, nil
+	}
+
+	d, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(network, address string) (net.Conn, error) {
+		var (
+			conn net.Conn
+			err  error
+		)
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			conn, err = cd.DialContext(ctx, network, address)
+		} else {
+			conn, err = d.Dial(network, address)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("via proxy %s: %v", u.Redacted(), err)
+		}
+		return conn, nil
+	}, nil
+}
+
+// dialConnect connects to address through an HTTP proxy, using the CONNECT
+// method. The connection to the proxy uses TLS for https proxies.
+func dialConnect(u *url.URL, forward *net.Dialer, timeout time.Duration, address string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := forward.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn is a connection of which some data may have been read into r
+// already.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
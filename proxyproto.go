@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every version 2 PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps a net.Listener whose connections start with a PROXY
+// protocol header, as sent by load balancers such as HAProxy or AWS NLB. The
+// connections it returns report the client address from the header. Headers
+// are read in the background, so that a slow client does not hold up Accept.
+type proxyListener struct {
+	net.Listener
+	conns chan net.Conn
+	err   chan error
+}
+
+func newProxyListener(l net.Listener) *proxyListener {
+	pl := &proxyListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+
+		go func() {
+			pc, err := readProxyHeader(c)
+			if err != nil {
+				logger.Log("proxy_protocol", fields{"remote_addr": c.RemoteAddr().String(), "error": err.Error()},
+					"%s: rejecting connection: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			l.conns <- pc
+		}()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// Keep the error around for later calls.
+		l.err <- err
+		return nil, err
+	}
+}
+
+// proxyConn is a connection whose PROXY protocol header has been read.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from c.
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{
+		Conn:   c,
+		r:      bufio.NewReader(c),
+		remote: c.RemoteAddr(),
+	}
+
+	start, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+
+	var addr net.Addr
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		addr, err = readProxyV1(pc.r)
+	case bytes.Equal(start, proxyV2Signature):
+		addr, err = readProxyV2(pc.r)
+	default:
+		err = errors.New("missing PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		pc.remote = addr
+	}
+	return pc, nil
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n". It returns a nil address
+// for "PROXY UNKNOWN".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A version 1 header is at most 107 bytes long.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY header")
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY header")
+	}
+
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY header")
+	}
+	if (parts[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.New("malformed PROXY header")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header. It returns a nil address for LOCAL
+// connections, such as health checks from the load balancer, and for
+// address families other than TCP over IPv4 and IPv6.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+
+	verCmd, family := hdr[12], hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.New("unsupported PROXY command")
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("malformed PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("malformed PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter keyed by an arbitrary string,
+// such as the source IP of a connection.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket for key, and reports whether one was
+// available. Buckets hold up to perMinute tokens, and refill at perMinute
+// tokens per minute.
+func (l *rateLimiter) allow(key string, perMinute int) bool {
+	now := time.Now()
+	max := float64(perMinute)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: max, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Minutes() * max
+	if b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup forgets buckets that have not been used for the given duration.
+// Such buckets are full again as long as the duration is at least a minute,
+// so forgetting them does not change the outcome of allow.
+func (l *rateLimiter) cleanup(unused time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= unused {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// isUnixPeer reports whether addr is that of a peer on a Unix socket. Such
+// peers have no IP address, so they are neither rate limited nor banned.
+func isUnixPeer(addr net.Addr) bool {
+	_, ok := addr.(*net.UnixAddr)
+	return ok || addr == nil
+}
+
+// remoteIP returns the IP part of a connection address.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
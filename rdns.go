@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reverseLookupTimeout bounds how long a reverse DNS lookup may take.
+	reverseLookupTimeout = 2 * time.Second
+
+	// reverseLookupTTL is how long the result of a lookup is kept, whether
+	// it succeeded or not.
+	reverseLookupTTL = 5 * time.Minute
+)
+
+// nameCache holds the names of client addresses, found by reverse DNS
+// lookups in the background.
+type nameCache struct {
+	mu      sync.Mutex
+	entries map[string]*nameEntry
+}
+
+type nameEntry struct {
+	name    string
+	expires time.Time
+}
+
+var clientNames = &nameCache{entries: make(map[string]*nameEntry)}
+
+// lookup starts a reverse lookup of ip, unless it was looked up recently.
+func (c *nameCache) lookup(ip string) {
+	c.mu.Lock()
+	if e, ok := c.entries[ip]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return
+	}
+	e := &nameEntry{expires: time.Now().Add(reverseLookupTTL)}
+	c.entries[ip] = e
+	c.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		if err != nil || len(names) == 0 {
+			return
+		}
+		c.mu.Lock()
+		e.name = strings.TrimSuffix(names[0], ".")
+		c.mu.Unlock()
+	}()
+}
+
+// get returns the name of ip, or "" if it is unknown.
+func (c *nameCache) get(ip string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[ip]; ok {
+		return e.name
+	}
+	return ""
+}
+
+// cleanup forgets the expired names.
+func (c *nameCache) cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for ip, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, ip)
+		}
+	}
+}
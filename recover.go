@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+
+	"github.com/joushou/sshmux"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errInternal is returned to sshmux in place of a recovered panic, which
+// ends the session it happened in.
+var errInternal = errors.New("internal error")
+
+// recoverPanic recovers a panic in one of the sshmux callbacks, logs it with
+// a stack trace, and sets *err so that only the affected session is ended.
+// It must be deferred directly.
+func recoverPanic(callback string, f fields, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if f == nil {
+		f = fields{}
+	}
+	stack := debug.Stack()
+	f["callback"] = callback
+	f["panic"] = fmt.Sprint(r)
+	f["stack"] = string(stack)
+	logger.Log("panic", f, "recovered panic in %s: %v\n%s", callback, r, stack)
+	*err = errInternal
+}
+
+// The safe versions of the callbacks given to sshmux recover panics, so
+// that a bug triggered by one client does not take down the daemon.
+
+func (d *daemon) safeAuth(c ssh.ConnMetadata, key ssh.PublicKey) (u *sshmux.User, err error) {
+	defer recoverPanic("auth", fields{"remote_addr": c.RemoteAddr().String(), "ssh_user": c.User()}, &err)
+	return d.auth(c, key)
+}
+
+func (d *daemon) safeSetup(session *sshmux.Session) (err error) {
+	defer recoverPanic("setup", fields{"remote_addr": session.Conn.RemoteAddr().String()}, &err)
+	return d.setup(session)
+}
+
+func (d *daemon) safeSelected(session *sshmux.Session, remote string) (err error) {
+	defer recoverPanic("selected", fields{"remote_addr": session.Conn.RemoteAddr().String(), "target": remote}, &err)
+	return d.selected(session, remote)
+}
+
+func (d *daemon) safeInteractive(rw io.ReadWriter, session *sshmux.Session) (remote string, err error) {
+	defer recoverPanic("interactive", fields{"remote_addr": session.Conn.RemoteAddr().String()}, &err)
+	return d.interactive(rw, session)
+}
+
+func (d *daemon) safeDial(network, address string) (conn net.Conn, err error) {
+	defer recoverPanic("dial", fields{"target": address}, &err)
+	return d.dial(network, address)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/joushou/sshmux"
+)
+
+// captureLog switches the logger to JSON records written to the returned
+// buffer, until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := logger.setFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	logger.setOutput(&buf)
+	t.Cleanup(func() {
+		logger.setFormat("text")
+		logger.setOutput(os.Stderr)
+	})
+	return &buf
+}
+
+// loggedEvents returns the records of the named event in buf.
+func loggedEvents(t *testing.T, buf *bytes.Buffer, event string) []map[string]interface{} {
+	var recs []map[string]interface{}
+	sc := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid log record %q: %v", sc.Text(), err)
+		}
+		if rec["event"] == event {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func TestRecoverPanic(t *testing.T) {
+	buf := captureLog(t)
+	c := testConn{user: "me", remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}}
+
+	// A state without a configuration makes the callbacks panic.
+	broken := newDaemon(nil, &state{})
+
+	u, err := broken.safeAuth(c, testUsers(t, 1)[0].user.PublicKey)
+	if err != errInternal || u != nil {
+		t.Fatalf("safeAuth returned %v, %v, want nil, %v", u, err, errInternal)
+	}
+	session := testSession(broken, &sshmux.User{Name: "me"}, "192.0.2.1")
+	if err := broken.safeSetup(session); err != errInternal {
+		t.Fatalf("safeSetup returned %v, want %v", err, errInternal)
+	}
+	if err := broken.safeSelected(session, "ssh1.example.com:22"); err != errInternal {
+		t.Fatalf("safeSelected returned %v, want %v", err, errInternal)
+	}
+	remote, err := broken.safeInteractive(&terminal{Reader: strings.NewReader("1\r")}, session)
+	if err != errInternal || remote != "" {
+		t.Fatalf("safeInteractive returned %q, %v, want \"\", %v", remote, err, errInternal)
+	}
+	conn, err := broken.safeDial("tcp", "ssh1.example.com:22")
+	if err != errInternal || conn != nil {
+		t.Fatalf("safeDial returned %v, %v, want nil, %v", conn, err, errInternal)
+	}
+
+	callbacks := []string{"auth", "setup", "selected", "interactive", "dial"}
+	recs := loggedEvents(t, buf, "panic")
+	if len(recs) != len(callbacks) {
+		t.Fatalf("logged %d panic events, want %d", len(recs), len(callbacks))
+	}
+	for i, callback := range callbacks {
+		rec := recs[i]
+		if rec["callback"] != callback || rec["level"] != "error" || rec["stack"] == "" {
+			t.Errorf("panic event %d is %v", i, rec)
+		}
+	}
+
+	// Other sessions are served as before.
+	users := testUsers(t, 1)
+	st, err := newState(&Conf{}, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = newDaemon(nil, st).safeAuth(c, users[0].user.PublicKey)
+	if err != nil || u != users[0].user {
+		t.Fatalf("safeAuth after a panic returned %v, %v", u, err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionInfo describes an open client connection.
+type sessionInfo struct {
+	id    uint64
+	conn  *trackedConn
+	start time.Time
+
+	mu       sync.Mutex
+	username string
+	sshUser  string
+	target   string
+	confirm  string // the remote host the user confirmed
+	authFail bool   // keys were rejected, and none accepted
+	charged  bool   // the rate limit was asked about the connection
+	throttle bool   // the rate limit refused the connection
+	limit    *time.Timer
+}
+
+// describe returns the log fields for the session.
+func (s *sessionInfo) describe() fields {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := fields{"session_id": s.id, "remote_addr": s.conn.RemoteAddr().String()}
+	if name := clientNames.get(remoteIP(s.conn.RemoteAddr())); name != "" {
+		f["remote_host"] = name
+	}
+	geo.addFields(remoteIP(s.conn.RemoteAddr()), f)
+	if s.username != "" {
+		f["username"] = s.username
+	}
+	if s.sshUser != "" {
+		f["ssh_user"] = s.sshUser
+	}
+	if s.target != "" {
+		f["target"] = s.target
+	}
+	return f
+}
+
+// sessionRegistry keeps track of the open client connections, keyed by their
+// remote address, so that information learned in the sshmux callbacks can be
+// tied back to the connection. The address values of trackedConns are unique
+// to each connection, even if their string forms are not.
+type sessionRegistry struct {
+	lastID uint64 // accessed atomically
+
+	mu       sync.Mutex
+	sessions map[net.Addr]*sessionInfo
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[net.Addr]*sessionInfo)}
+}
+
+func (r *sessionRegistry) add(c *trackedConn) *sessionInfo {
+	s := &sessionInfo{
+		id:    atomic.AddUint64(&r.lastID, 1),
+		conn:  c,
+		start: time.Now(),
+	}
+	r.mu.Lock()
+	r.sessions[c.RemoteAddr()] = s
+	r.mu.Unlock()
+	return s
+}
+
+func (r *sessionRegistry) remove(c *trackedConn) {
+	r.mu.Lock()
+	s := r.sessions[c.RemoteAddr()]
+	delete(r.sessions, c.RemoteAddr())
+	r.mu.Unlock()
+
+	if s != nil {
+		s.mu.Lock()
+		if s.limit != nil {
+			s.limit.Stop()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// get returns the session for the given remote address, or nil.
+func (r *sessionRegistry) get(addr net.Addr) *sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[addr]
+}
+
+// byID returns the session with the given ID, or nil.
+func (r *sessionRegistry) byID(id uint64) *sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// list returns the open sessions, in no particular order.
+func (r *sessionRegistry) list() []*sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*sessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		res = append(res, s)
+	}
+	return res
+}
+
+// describeAll returns the fields describing each open session, including
+// its start time and duration.
+func (r *sessionRegistry) describeAll() []fields {
+	sessions := r.list()
+	res := make([]fields, 0, len(sessions))
+	for _, s := range sessions {
+		f := s.describe()
+		f["start"] = s.start.Format(time.RFC3339)
+		f["duration"] = time.Since(s.start).Truncate(time.Second).String()
+		res = append(res, f)
+	}
+	return res
+}
+
+// others returns the sessions of the named user, other than the one with the
+// given remote address.
+func (r *sessionRegistry) others(addr net.Addr, username string) []*sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var res []*sessionInfo
+	for a, s := range r.sessions {
+		if a == addr {
+			continue
+		}
+		s.mu.Lock()
+		if s.username == username {
+			res = append(res, s)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].start.Before(res[j].start) })
+	return res
+}
+
+// idleClosed logs that the session is closed for being idle.
+func (s *sessionInfo) idleClosed(timeout time.Duration) {
+	logger.Log("idle_timeout", s.describe(), "%s: closing connection idle for %v", s.conn.RemoteAddr(), timeout)
+}
+
+// setIdleTimeout replaces the idle timeout of the session with the given
+// remote address.
+func (r *sessionRegistry) setIdleTimeout(addr net.Addr, timeout time.Duration) {
+	if s := r.get(addr); s != nil {
+		s.conn.closeWhenIdle(timeout, s.idleClosed)
+	}
+}
+
+// setConfirmed records that the user of the session with the given remote
+// address confirmed the connection to a remote host.
+func (r *sessionRegistry) setConfirmed(addr net.Addr, remote string) {
+	if s := r.get(addr); s != nil {
+		s.mu.Lock()
+		s.confirm = remote
+		s.mu.Unlock()
+	}
+}
+
+// confirmed reports whether the user of the session with the given remote
+// address confirmed the connection to a remote host.
+func (r *sessionRegistry) confirmed(addr net.Addr, remote string) bool {
+	s := r.get(addr)
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.confirm == remote
+}
+
+// throttled reports whether authentication on the session with the given
+// remote address is refused by the rate limit. allow is only asked on the
+// first attempt of a session, so that a client offering several keys is
+// charged once.
+func (r *sessionRegistry) throttled(addr net.Addr, allow func() bool) bool {
+	s := r.get(addr)
+	if s == nil {
+		return !allow()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.charged {
+		s.charged = true
+		s.throttle = !allow()
+	}
+	return s.throttle
+}
+
+// setAuthFailed records whether the last authentication attempt of the
+// session with the given remote address was rejected.
+func (r *sessionRegistry) setAuthFailed(addr net.Addr, failed bool) {
+	if s := r.get(addr); s != nil {
+		s.mu.Lock()
+		s.authFail = failed
+		s.mu.Unlock()
+	}
+}
+
+// failedAuth reports whether the session ended up failing to authenticate.
+func (s *sessionInfo) failedAuth() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authFail
+}
+
+// setUser records the user of the session with the given remote address.
+func (r *sessionRegistry) setUser(addr net.Addr, username, sshUser string) {
+	if s := r.get(addr); s != nil {
+		s.mu.Lock()
+		s.username = username
+		s.sshUser = sshUser
+		s.mu.Unlock()
+	}
+}
+
+// setUserLimited records the user like setUser, unless the user already has
+// max other sessions open. A max of zero or less means no limit.
+func (r *sessionRegistry) setUserLimited(addr net.Addr, username, sshUser string, max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[addr]
+	if s == nil {
+		return true
+	}
+
+	if max > 0 {
+		n := 0
+		for a, other := range r.sessions {
+			if a == addr {
+				continue
+			}
+			other.mu.Lock()
+			if other.username == username {
+				n++
+			}
+			other.mu.Unlock()
+		}
+		if n >= max {
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	s.username = username
+	s.sshUser = sshUser
+	s.mu.Unlock()
+	return true
+}
+
+// setTargetLimited records the remote host selected by the session with the
+// given remote address, unless max other sessions are connected to it
+// already. A max of zero or less means no
+// limit.
+func (r *sessionRegistry) setTargetLimited(addr net.Addr, target string, max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[addr]
+	if s == nil {
+		return true
+	}
+
+	if max > 0 {
+		n := 0
+		for a, other := range r.sessions {
+			if a == addr {
+				continue
+			}
+			other.mu.Lock()
+			if other.target == target {
+				n++
+			}
+			other.mu.Unlock()
+		}
+		if n >= max {
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	s.target = target
+	s.mu.Unlock()
+	return true
+}
+
+// limitDuration closes the session with the given remote address once it
+// has lasted for d, calling onExpire first.
+func (r *sessionRegistry) limitDuration(addr net.Addr, d time.Duration, onExpire func(*sessionInfo)) {
+	s := r.get(addr)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.limit != nil {
+		s.limit.Stop()
+	}
+	s.limit = time.AfterFunc(d, func() {
+		onExpire(s)
+		s.conn.Close()
+	})
+	s.mu.Unlock()
+}
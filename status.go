@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of a metrics counter.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// logStatus logs the uptime, the connection and authentication counters, and
+// the number of open sessions to each remote host. As it is asked for, the
+// status is logged whatever the log level.
+func (d *daemon) logStatus() {
+	uptime := d.uptime()
+	total := atomic.LoadUint64(&d.sessions.lastID)
+	active := d.conns.count()
+	succeeded := int64(counterValue(authentications.WithLabelValues("success")))
+	failed := int64(counterValue(authentications.WithLabelValues("failure")))
+
+	logger.write(levelError, "status", fields{
+		"uptime":          uptime.String(),
+		"connections":     total,
+		"active_sessions": active,
+		"auth_successes":  succeeded,
+		"auth_failures":   failed,
+		"draining":        d.isDraining(),
+	}, "up %v, %d connections served, %d active, %d authentications succeeded, %d failed, draining: %v",
+		uptime, total, active, succeeded, failed, d.isDraining())
+
+	perRemote := make(map[string]int)
+	for _, s := range d.sessions.list() {
+		s.mu.Lock()
+		if s.target != "" {
+			perRemote[s.target]++
+		}
+		s.mu.Unlock()
+	}
+	remotes := make([]string, 0, len(perRemote))
+	for r := range perRemote {
+		remotes = append(remotes, r)
+	}
+	sort.Strings(remotes)
+	for _, r := range remotes {
+		logger.write(levelError, "status", fields{"target": r, "active_sessions": perRemote[r]},
+			"%s: %d active sessions", r, perRemote[r])
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "io"
+
+func openSyslog(facility, tag string) (io.Writer, error) {
+	return nil, errNoSyslog
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultDialTimeout bounds connections to remote hosts, unless configured
+// otherwise.
+const defaultDialTimeout = 10 * time.Second
+
+// defaultDialRetryBackoff is the wait before the first retry of a failed
+// connection, unless configured otherwise. It doubles with every retry.
+const defaultDialRetryBackoff = 500 * time.Millisecond
+
+// loadKnownHosts returns the host key callback to use for the jump hosts of
+// each host address. Hosts without a known_hosts file, or with
+// insecureSkipHostKeyCheck set, are left out.
+func loadKnownHosts(c *Conf) (map[string]ssh.HostKeyCallback, error) {
+	files := make(map[string]ssh.HostKeyCallback)
+	callbacks := make(map[string]ssh.HostKeyCallback)
+
+	for _, h := range c.Hosts {
+		if h.InsecureSkipHostKeyCheck {
+			continue
+		}
+
+		filename := h.KnownHosts
+		if filename == "" {
+			filename = c.KnownHosts
+		}
+		if filename == "" {
+			continue
+		}
+
+		cb, ok := files[filename]
+		if !ok {
+			var err error
+			cb, err = knownhosts.New(filename)
+			if err != nil {
+				return nil, fmt.Errorf("knownHosts: %v", err)
+			}
+			files[filename] = cb
+		}
+		callbacks[h.Address] = cb
+	}
+
+	return callbacks, nil
+}
+
+// dial connects to a remote host on behalf of sshmux. Hosts with several
+// backend addresses are dialed round-robin, moving on to the next backend if
+// one cannot be reached. The fallback address of a host is tried last.
+func (st *state) dial(network, address string) (net.Conn, error) {
+	address = st.canonical(address)
+	h := st.conf.host(address)
+
+	timeout := time.Duration(st.conf.DialTimeout)
+	if h != nil && h.DialTimeout != 0 {
+		timeout = time.Duration(h.DialTimeout)
+	}
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	backends := []string{address}
+	if h != nil {
+		if len(h.Addresses) > 0 {
+			backends = h.backendOrder(atomic.AddUint32(st.next[address], 1) - 1)
+		}
+		if h.FallbackAddress != "" {
+			backends = append(backends, h.FallbackAddress)
+		}
+	}
+
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%s: all backends are drained", address)
+	}
+
+	var err error
+	for _, backend := range backends {
+		var conn net.Conn
+		conn, err = st.dialRetry(network, address, backend, timeout)
+		if err == nil {
+			if backend != address {
+				logger.Log("backend", fields{"target": address, "backend": backend},
+					"%s: using backend %s", address, backend)
+			}
+			return conn, nil
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = fmt.Errorf("connecting to %s timed out after %v", backend, timeout)
+		}
+		logger.Log("dial_failed", fields{"target": address, "backend": backend, "error": err.Error()},
+			"%s: %v", address, err)
+	}
+	if len(backends) > 1 {
+		return nil, fmt.Errorf("%s: all %d backends failed, last error: %v", address, len(backends), err)
+	}
+	return nil, err
+}
+
+// dialRetry connects to a backend address, retrying up to dialRetries times
+// if the connection fails with a transient error.
+func (st *state) dialRetry(network, address, backend string, timeout time.Duration) (net.Conn, error) {
+	backoff := time.Duration(st.conf.DialRetryBackoff)
+	if backoff <= 0 {
+		backoff = defaultDialRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := st.dialBackend(network, address, backend, timeout)
+		if err == nil || attempt > st.conf.DialRetries || !isTransient(err) {
+			return conn, err
+		}
+
+		logger.Log("dial_retry", fields{"target": address, "backend": backend, "attempt": attempt, "error": err.Error()},
+			"%s: connecting to %s failed, retrying in %v: %v", address, backend, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether a failed connection may succeed if tried
+// again: the remote refused or reset the connection, or it timed out.
+func isTransient(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// dialBackend connects to a backend address of the given remote host. The
+// host key of the remote host is not verified, as sshmux performs the
+// upstream handshake itself.
+func (st *state) dialBackend(network, address, backend string, timeout time.Duration) (net.Conn, error) {
+	dial, err := st.hostDialer(st.conf.host(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return dial(network, backend)
+}
+
+// hostDialer returns the function connecting to the backends of h, through
+// its proxy and jump hosts, if any. h may be nil for addresses that are not
+// configured.
+func (st *state) hostDialer(h *Host, timeout time.Duration) (dialFunc, error) {
+	// These are TCP keepalives. Zero uses the default of 15s, and a
+	// negative value disables them.
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: time.Duration(st.conf.UpstreamKeepalive),
+	}
+
+	dial := dialFunc(dialer.Dial)
+	if h != nil {
+		var err error
+		if h.Proxy != "" {
+			if dial, err = proxyDialer(h.Proxy, dialer, timeout); err != nil {
+				return nil, err
+			}
+		}
+		if len(h.Jump) > 0 {
+			if dial, err = st.jumpDialer(h, dial, timeout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dial, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// These are set at build time, such as with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("sshmuxd %s (commit %s, built %s)", version, commit, buildDate)
+}
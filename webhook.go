@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many events may wait for delivery before new
+	// ones are dropped.
+	webhookQueueSize = 1024
+
+	// webhookAttempts is how often delivery of an event is attempted.
+	webhookAttempts = 3
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook delivers session events to the configured webhookURL in the
+// background, so that a slow endpoint does not hold up the sessions.
+type webhook struct {
+	queue chan fields
+}
+
+func newWebhook() *webhook {
+	return &webhook{queue: make(chan fields, webhookQueueSize)}
+}
+
+// notify queues an event for delivery. If the queue is full, the event is
+// dropped.
+func (w *webhook) notify(event string, f fields) {
+	rec := make(fields, len(f)+2)
+	for k, v := range f {
+		rec[k] = v
+	}
+	rec["event"] = event
+	rec["time"] = time.Now().Format(time.RFC3339Nano)
+
+	select {
+	case w.queue <- rec:
+	default:
+		logger.Log("webhook", fields{"event": event}, "webhook queue full, dropping %s event", event)
+	}
+}
+
+// run delivers queued events to the webhookURL of the current configuration.
+// It does not return.
+func (w *webhook) run(d *daemon) {
+	for rec := range w.queue {
+		url := d.state().conf.WebhookURL
+		if url == "" {
+			continue
+		}
+
+		var err error
+		for i := 0; i < webhookAttempts; i++ {
+			if i > 0 {
+				time.Sleep(time.Duration(i) * time.Second)
+			}
+			if err = postEvent(url, rec); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Log("webhook", fields{"event": rec["event"], "error": err.Error()},
+				"dropping %s event after %d failed deliveries: %v", rec["event"], webhookAttempts, err)
+		}
+	}
+}
+
+// postEvent posts an event as JSON.
+func postEvent(url string, rec fields) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow is a recurring weekly time window, such as
+// "Mon-Fri 09:00-17:00 America/New_York".
+type accessWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+	loc        *time.Location
+}
+
+// parseAccessWindow parses a window of the form "DAYS START-END [ZONE]". DAYS
+// is a comma-separated list of weekdays or weekday ranges, such as
+// "Mon-Fri" or "Mon,Wed,Sat-Sun". A window ending before it starts extends
+// past midnight. ZONE is an IANA time zone name, and defaults to UTC.
+func parseAccessWindow(s string) (*accessWindow, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("access window %q: expected \"DAYS START-END [ZONE]\"", s)
+	}
+
+	w := &accessWindow{loc: time.UTC}
+	for _, r := range strings.Split(parts[0], ",") {
+		first, last := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			first, last = r[:i], r[i+1:]
+		}
+		from, ok1 := weekdays[strings.ToLower(first)]
+		to, ok2 := weekdays[strings.ToLower(last)]
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("access window %q: invalid days %q", s, r)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	times := strings.Split(parts[1], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("access window %q: invalid time range %q", s, parts[1])
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return nil, fmt.Errorf("access window %q: %v", s, err)
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return nil, fmt.Errorf("access window %q: %v", s, err)
+	}
+
+	if len(parts) == 3 {
+		if w.loc, err = time.LoadLocation(parts[2]); err != nil {
+			return nil, fmt.Errorf("access window %q: %v", s, err)
+		}
+	}
+
+	return w, nil
+}
+
+// parseClock parses a time of day such as "09:30" into minutes since
+// midnight. "24:00" is accepted as the end of the day.
+func parseClock(s string) (int, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err1 := strconv.Atoi(s[:i])
+	m, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether t falls within the window.
+func (w *accessWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	day := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+
+	if w.start <= w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+
+	// The window extends past midnight into the next day.
+	prev := (day + 6) % 7
+	return (w.days[day] && m >= w.start) || (w.days[prev] && m < w.end)
+}